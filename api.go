@@ -10,18 +10,15 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
-	"strconv"
 	"strings"
-	"sync"
-	"sync/atomic"
 	"time"
-
-	"github.com/gorilla/websocket"
 )
 
 type serverConn struct {
 	authHeaderValue string
 	serverLocation  string
+	// policy is the delivery policy of this connection, see API.deliveryPolicy
+	policy string
 }
 
 // API holds information used to communicate with the RT-CV api
@@ -33,22 +30,47 @@ type API struct {
 	mockCache map[string]time.Time
 
 	CancelPreviouseCommunicationChan chan struct{}
-	WebsocketReq                     chan []byte
-	WebsocketRespLock                sync.Mutex
-	WebsocketResp                    []chan []byte
-
-	Cache map[string]time.Time
+	// WSRequests contains the websocket requests of RT-CV that are waiting to be consumed by the scraper
+	WSRequests *wsRequestQueue
+	wsPending  *wsPendingRequests
+	wsConfig   wsSessionConfig
+	// wsSessions contains the websocket session of every connection, the index matches the connections index
+	wsSessions []*wsSession
+
+	Cache *CacheNamespaces
+	// SharedCache is an optional cache shared with other scraper clients
+	SharedCache CacheBackend
+
+	// Outbox contains the cv requests that still need to be delivered, nil if the outbox is disabled
+	Outbox *Outbox
+	// Jobs executes the cvs send with async
+	Jobs *Jobs
+
+	routingRules []EnvRoutingRule
+
+	// Scrapers are the scraper commands supervised by the client, empty if not yet started
+	Scrapers []*Scraper
+	// Logs captures the output of the scrapers, nil if the output is not captured
+	Logs      *Logs
+	startedAt time.Time
+	// wsHandlers contains the websocket message types the client answers itself, see RegisterWSHandler
+	wsHandlers map[string]wsHandler
 }
 
 // NewAPI creates a new instance of the API
 func NewAPI() *API {
-	return &API{
+	api := &API{
 		CancelPreviouseCommunicationChan: make(chan struct{}),
-		WebsocketReq:                     make(chan []byte),
-		WebsocketResp:                    []chan []byte{},
+		WSRequests:                       newWSRequestQueue(1_000),
+
+		Cache: NewCacheNamespaces(time.Minute),
 
-		Cache: map[string]time.Time{},
+		startedAt:  time.Now(),
+		wsHandlers: builtinWSHandlers(),
 	}
+	api.Jobs = NewJobs(api, 4, 1_000)
+	api.wsPending = newWSPendingRequests(api)
+	return api
 }
 
 // SetMockMode enables mock mode, which can be used for testing
@@ -65,6 +87,9 @@ type SetCredentialsArg struct {
 	APIKeyID       string `json:"api_key_id"`
 	APIKey         string `json:"api_key"`
 	Primary        bool   `json:"primary"`
+	// DeliveryPolicy is one of required, best_effort or queue
+	// If empty queue is used when the outbox is enabled and otherwise required
+	DeliveryPolicy string `json:"delivery_policy"`
 }
 
 // SetCredentials sets the api credentials so we can make fetch requests to RT-CV
@@ -94,6 +119,13 @@ func (a *API) SetCredentials(credentialsList []SetCredentialsArg) error {
 		hashedAPIKeyStr := hex.EncodeToString(hashedAPIKey[:])
 		conn.authHeaderValue = "Basic " + credentials.APIKeyID + ":" + hashedAPIKeyStr
 
+		switch credentials.DeliveryPolicy {
+		case "", policyRequired, policyBestEffort, policyQueue:
+			conn.policy = credentials.DeliveryPolicy
+		default:
+			return errors.New("delivery_policy must be one of: required, best_effort, queue")
+		}
+
 		a.connections = append(a.connections, conn)
 
 		if credentials.Primary {
@@ -119,6 +151,16 @@ func (a *API) SetCredentials(credentialsList []SetCredentialsArg) error {
 	return nil
 }
 
+// connectionByLocation returns the connection and it's index for a server location
+func (a *API) connectionByLocation(serverLocation string) (serverConn, int, bool) {
+	for idx, conn := range a.connections {
+		if conn.serverLocation == serverLocation {
+			return conn, idx, true
+		}
+	}
+	return serverConn{}, -1, false
+}
+
 // Get makes a get request to RT-CV
 func (c *serverConn) Get(path string, unmarshalResInto any) error {
 	req, err := c.prepairJSONReq("GET", path, nil)
@@ -159,27 +201,6 @@ func (c *serverConn) prepairJSONReq(method, path string, body any) (*http.Reques
 	return req, err
 }
 
-// Post makes a post request to RT-CV with formdata instaid of json data
-func (c *serverConn) PostFormData(path string, form io.Reader, boundry string, unmarshalResInto any) error {
-	req, err := c.prepairFormReq("POST", path, form, boundry)
-	if err != nil {
-		return err
-	}
-
-	return c.DoRequest(req, unmarshalResInto)
-}
-
-func (c *serverConn) prepairFormReq(method, path string, body io.Reader, boundry string) (*http.Request, error) {
-	req, err := http.NewRequest(method, c.serverLocation+path, body)
-	if err != nil {
-		return nil, err
-	}
-
-	req.Header.Add("Content-Type", "multipart/form-data; boundary="+boundry)
-
-	return req, err
-}
-
 // DoRequest makes a http request to RT-CV
 func (c *serverConn) DoRequest(req *http.Request, unmarshalResInto any) error {
 	if c.authHeaderValue != "" {
@@ -221,41 +242,6 @@ func (c *serverConn) DoRequest(req *http.Request, unmarshalResInto any) error {
 	}
 }
 
-func (c *serverConn) tryConnectToWS() *websocket.Conn {
-	url := c.serverLocation
-	url = strings.Replace(url, "http://", "ws://", 1)
-	url = strings.Replace(url, "https://", "wss://", 1)
-	url += "/api/v1/scraper/ws"
-
-	attempt := 0
-	for {
-		conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": []string{c.authHeaderValue}})
-		if err == nil {
-			if attempt > 0 {
-				fmt.Println("connected to web socket")
-			}
-			return conn
-		}
-
-		attempt++
-		retryInSeconds := time.Second
-		if attempt == 1 {
-			// retry in 1 second
-		} else if attempt <= 2 {
-			retryInSeconds *= 2
-		} else if attempt <= 4 {
-			retryInSeconds *= 4
-		} else if attempt <= 6 {
-			retryInSeconds *= 10
-		} else {
-			retryInSeconds *= 15
-		}
-
-		fmt.Printf("unable to connect to web socket, error: %s, retrying in %s\n", err, retryInSeconds)
-		time.Sleep(retryInSeconds)
-	}
-}
-
 // NoCredentials returns true if the SetCredentials method was not yet called and we aren't in mock mode
 func (a *API) NoCredentials() bool {
 	return len(a.connections) == 0 && !a.MockMode
@@ -265,200 +251,64 @@ func (a *API) NoCredentials() bool {
 // while we're trying to execute an action that requires them
 var ErrMissingCredentials = errors.New("missing credentials, call set_credentials before this method")
 
-// SetCacheEntry sets a cache entry for the reference number that expires after the duration
-func (a *API) SetCacheEntry(referenceNr string, duration time.Duration) {
-	a.Cache[referenceNr] = time.Now().Add(duration)
+// SetCacheEntry sets a cache entry for the reference number within the namespace that expires after the duration
+func (a *API) SetCacheEntry(namespace, referenceNr string, duration time.Duration) {
+	a.SetCacheEntryExpires(namespace, referenceNr, time.Now().Add(duration))
 }
 
-// CacheEntryExists returns true if the cache entry exists and is not expired
-func (a *API) CacheEntryExists(referenceNr string) bool {
-	cacheEntryInsertionTime, cacheEntryExists := a.Cache[referenceNr]
-	if !cacheEntryExists {
-		return false
-	}
+// SetCacheEntryExpires sets a cache entry for the reference number within the namespace that expires at the expires time
+func (a *API) SetCacheEntryExpires(namespace, referenceNr string, expires time.Time) {
+	a.Cache.Namespace(namespace).Set(referenceNr, expires)
 
-	expired := time.Now().After(cacheEntryInsertionTime)
-	if expired {
-		delete(a.Cache, referenceNr)
+	if a.SharedCache != nil {
+		err := a.SharedCache.Set(namespace, referenceNr, expires)
+		if err != nil && err != ErrCacheBackendUnavailable {
+			fmt.Println("WARN: unable to set shared cache entry, error:", err)
+		}
 	}
-	return !expired
 }
 
-// WSMsg is a message recived and send to the websocket
-type WSMsg[T any] struct {
-	Type string `json:"type"`
-	ID   string `json:"id,omitempty"`
-	Data T      `json:"data"`
+// ImportCacheEntries reads newline delimited json entries from r and sets them in the namespace
+// Like SetCacheEntryExpires the entries are also written to the shared cache, returns the amount of imported entries
+func (a *API) ImportCacheEntries(namespace string, r io.Reader) (int, error) {
+	return importCacheEntries(r, func(referenceNr string, expires time.Time) {
+		a.SetCacheEntryExpires(namespace, referenceNr, expires)
+	})
 }
 
-// HandleWebsocketResponse handles a websocket response
-// This decodes the payload and checks to which connected websocket it should be sent
-func (a *API) HandleWebsocketResponse(payload []byte) {
-	if a.MockMode {
-		return
-	}
-
-	data := WSMsg[json.RawMessage]{}
-	err := json.Unmarshal(payload, &data)
-	if err != nil {
-		fmt.Println("error un-marshaling websocket response, error:", err)
-		return
+// CacheEntryExists returns true if the cache entry exists within the namespace and is not expired
+// If the entry is not in the local cache the shared cache is checked
+func (a *API) CacheEntryExists(namespace, referenceNr string) bool {
+	if a.Cache.Lookup(namespace).Exists(referenceNr) {
+		return true
 	}
 
-	idParts := strings.SplitN(data.ID, "-", 2)
-	if len(idParts) != 2 {
-		fmt.Println("error invalid id in websocket response, expected 2 parts but got 1")
-		return
-	}
-
-	idx, err := strconv.Atoi(idParts[0])
-	if err != nil {
-		fmt.Println("error invalid id connection index in websocket response, error:", err)
-		return
+	if a.SharedCache == nil {
+		return false
 	}
 
-	data.ID = idParts[1]
-
-	// Re-encode data with the new ID
-	payload, err = json.Marshal(data)
+	_, exists, err := a.SharedCache.Get(namespace, referenceNr)
 	if err != nil {
-		fmt.Println("error marshaling websocket response, error:", err)
-		return
-	}
-
-	a.WebsocketRespLock.Lock()
-	// Data sending of the channel is thread safe but fething the array index is not hence why we lock WebsocketRespLock
-	a.WebsocketResp[idx] <- payload
-	a.WebsocketRespLock.Unlock()
-}
-
-// ConnectToAllWebsockets connects to all the conenctions their websocket
-func (a *API) ConnectToAllWebsockets() {
-	if a.MockMode {
-		return
-	}
-
-	a.WebsocketResp = make([]chan []byte, len(a.connections))
-	for idx := 0; idx < len(a.connections); idx++ {
-		go a.connectToWS(idx)
+		// The backend already warns when it becomes unavailable
+		if err != ErrCacheBackendUnavailable {
+			fmt.Println("WARN: unable to get shared cache entry, error:", err)
+		}
+		return false
 	}
+	// Shared hits are not copied into the local cache so a delete on another instance is seen on the next lookup
+	return exists
 }
 
-// connectToWS connects to the rtcv websocket
-func (a *API) connectToWS(idx int) {
-	server := a.connections[idx]
+// DeleteCacheEntry removes a cache entry from the namespace, returns true if the entry existed in the local cache
+func (a *API) DeleteCacheEntry(namespace, referenceNr string) bool {
+	existed := a.Cache.Lookup(namespace).Delete(referenceNr)
 
-	url := server.serverLocation
-	url = strings.Replace(url, "http://", "ws://", 1)
-	url = strings.Replace(url, "https://", "wss://", 1)
-	url += "/api/v1/scraper/ws"
-
-	var c *websocket.Conn
-	defer func() {
-		if c != nil {
-			c.Close()
-		}
-	}()
-
-	a.WebsocketRespLock.Lock()
-	a.WebsocketResp[idx] = make(chan []byte)
-	listenChan := &a.WebsocketResp[idx]
-	a.WebsocketRespLock.Unlock()
-
-	go func(ws *chan []byte) {
-		// Send keep alive messages every 20 seconds
-		// There is at least one proxy service in our cluster that closes the connection after 30 seconds of inactivity
-		// This is to prevent the connection beeing closed
-		keepAliveTicker := time.NewTicker(time.Second * 20)
-		keepAliveBody := []byte("pnig")
-		for {
-			select {
-			case <-keepAliveTicker.C:
-				c.WriteMessage(websocket.PingMessage, keepAliveBody)
-			case resp := <-a.WebsocketResp[idx]:
-				// TODO: if the response fails to send data might get lost.
-				//   It would be nice if the response is retried when WriteMessage fails
-				err := c.WriteMessage(1, resp)
-				if err != nil {
-					fmt.Println("unable to write ws response:", err)
-				}
-			}
+	if a.SharedCache != nil {
+		err := a.SharedCache.Delete(namespace, referenceNr)
+		if err != nil && err != ErrCacheBackendUnavailable {
+			fmt.Println("WARN: unable to delete shared cache entry, error:", err)
 		}
-	}(listenChan)
-
-	firstMessage := true
-	var aMessageWasHandled atomic.Bool
-	for {
-		c = a.connections[0].tryConnectToWS()
-
-		for {
-			msgType, msgBytes, err := c.ReadMessage()
-			if err != nil {
-				fmt.Println("error reading from web socket:", err)
-				break
-			}
-
-			switch msgType {
-			case 1, 2:
-				// 1 - text message
-				// 2 - binary message
-				// Ok continue
-			default:
-				// Ignore other message types
-				continue
-			}
-
-			msg := WSMsg[json.RawMessage]{}
-			err = json.Unmarshal(msgBytes, &msg)
-			if err != nil {
-				fmt.Println("error un-marshaling web socket message:", err)
-				continue
-			}
-
-			// We inject the index of the server connection into the message id so we know where to send the response to later
-			// See the /server_response for how we handle the response
-			msg.ID = fmt.Sprintf("%d-%s", idx, msg.ID)
-
-			msgBytes, err = json.Marshal(msg)
-			if err != nil {
-				fmt.Println("error marshaling web socket message:", err)
-				continue
-			}
-
-			timeout := time.Second
-			if aMessageWasHandled.Load() || firstMessage {
-				// It might be this scraper does not listen to the /server_request url thus we will try to send something over a channel that will never read
-				// That's a lot of waisted time
-				timeout = time.Second * 30
-			}
-			firstMessage = false
-
-			go func(msgBytes []byte, timeout time.Duration) {
-				select {
-				case a.WebsocketReq <- msgBytes:
-					// Ok message was send
-					aMessageWasHandled.Store(true)
-				case <-time.After(timeout):
-					errMsg := "Unable to handle request by RT-CV server"
-					if !aMessageWasHandled.Load() {
-						errMsg += ", probably becuase there is no one waiting for a response"
-					}
-					fmt.Println(errMsg)
-				}
-			}(msgBytes, timeout)
-		}
-
-		c.Close()
 	}
 
-}
-
-// CancelPreviouseCommunication cancels the previous communication if it's still running
-func (a *API) CancelPreviouseCommunication() {
-	select {
-	case a.CancelPreviouseCommunicationChan <- struct{}{}:
-		// A previous communication was canceled
-	default:
-		// There are no more previous communications to cancel
-	}
+	return existed
 }
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// cacheShardsCount is the amount of shards the reference cache is split into
+// Every shard has it's own lock so concurrent requests for diffrent reference numbers rarely wait on each other
+const cacheShardsCount = 32
+
+// ReferenceCache is a concurrency safe cache of reference numbers with an expiry time
+type ReferenceCache struct {
+	namespace string
+	shards    [cacheShardsCount]*cacheShard
+
+	// TTL is the time to live used by /send_cv and /set_cached_reference
+	TTL time.Duration
+	// ShortTTL is the time to live used by /set_short_cached_reference
+	ShortTTL time.Duration
+
+	fileLock sync.Mutex
+	file     *cacheFile
+}
+
+type cacheShard struct {
+	lock       sync.Mutex
+	maxEntries int
+	entries    map[string]*list.Element
+	// lru contains the *cacheEntry values of this shard, the front is the most recently used entry
+	lru *list.List
+
+	hits      uint64
+	misses    uint64
+	evictions uint64
+	expired   uint64
+}
+
+type cacheEntry struct {
+	referenceNr string
+	expires     time.Time
+}
+
+// CacheEntry is the json representation of a cache entry
+// It's used by the cache file and the cache import and export routes
+type CacheEntry struct {
+	// Namespace is only used within the cache file
+	Namespace   string `json:"namespace,omitempty"`
+	ReferenceNr string `json:"referenceNr"`
+	// Expires is the unix timestamp in seconds when the entry expires
+	Expires int64 `json:"expires"`
+}
+
+func encodeCacheEntry(namespace, referenceNr string, expires time.Time) ([]byte, error) {
+	line, err := json.Marshal(CacheEntry{
+		Namespace:   namespace,
+		ReferenceNr: referenceNr,
+		Expires:     expires.Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// NewReferenceCache creates a new reference cache
+// Expired entries are removed when they are looked up or when RemoveExpired is called
+func NewReferenceCache(namespace string) *ReferenceCache {
+	c := &ReferenceCache{
+		namespace: namespace,
+		TTL:       defaultCacheTTL,
+		ShortTTL:  shortCacheTTL,
+	}
+	for idx := range c.shards {
+		c.shards[idx] = &cacheShard{
+			entries: map[string]*list.Element{},
+			lru:     list.New(),
+		}
+	}
+
+	return c
+}
+
+func (c *ReferenceCache) shard(referenceNr string) *cacheShard {
+	h := fnv.New32a()
+	h.Write([]byte(referenceNr))
+	return c.shards[h.Sum32()%cacheShardsCount]
+}
+
+// SetMaxEntries limits the amount of entries in the cache, if the cache is full the least recently used entries are evicted
+// A value of 0 or lower means there is no limit
+//
+// The limit is spread evenly over the shards so the cache might evict entries slightly before max entries is reached
+func (c *ReferenceCache) SetMaxEntries(maxEntries int) {
+	perShard := 0
+	if maxEntries > 0 {
+		perShard = (maxEntries + cacheShardsCount - 1) / cacheShardsCount
+	}
+
+	evicted := []string{}
+	for _, shard := range c.shards {
+		shard.lock.Lock()
+		shard.maxEntries = perShard
+		evicted = append(evicted, shard.evictOverflow()...)
+		shard.lock.Unlock()
+	}
+	c.deleteFromFile(evicted)
+}
+
+// useFile writes all future cache entries to the file f
+// Entries that are evicted while loading the entries are marked as deleted in the file
+func (c *ReferenceCache) useFile(f *cacheFile, entries map[string]time.Time) {
+	evicted := []string{}
+	for referenceNr, expires := range entries {
+		evicted = append(evicted, c.set(referenceNr, expires)...)
+	}
+
+	c.fileLock.Lock()
+	c.file = f
+	c.fileLock.Unlock()
+
+	c.deleteFromFile(evicted)
+}
+
+// currentFile returns the file the cache writes to or nil if the cache is not written to a file
+func (c *ReferenceCache) currentFile() *cacheFile {
+	c.fileLock.Lock()
+	defer c.fileLock.Unlock()
+	return c.file
+}
+
+// deleteFromFile marks the reference numbers as deleted in the cache file so they are not loaded again after a restart
+func (c *ReferenceCache) deleteFromFile(referenceNrs []string) {
+	f := c.currentFile()
+	if f == nil {
+		return
+	}
+	for _, referenceNr := range referenceNrs {
+		err := f.Delete(c.namespace, referenceNr)
+		if err != nil {
+			fmt.Println("WARN: unable to write to cache file, error:", err)
+			return
+		}
+	}
+}
+
+// Set sets a cache entry for the reference number that expires at the expires time
+func (c *ReferenceCache) Set(referenceNr string, expires time.Time) {
+	evicted := c.set(referenceNr, expires)
+
+	f := c.currentFile()
+	if f != nil {
+		err := f.Set(c.namespace, referenceNr, expires)
+		if err != nil {
+			fmt.Println("WARN: unable to write to cache file, error:", err)
+		}
+	}
+	c.deleteFromFile(evicted)
+}
+
+// set sets a cache entry in memory, returns the reference numbers that were evicted to make room for the entry
+func (c *ReferenceCache) set(referenceNr string, expires time.Time) []string {
+	shard := c.shard(referenceNr)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	el, ok := shard.entries[referenceNr]
+	if ok {
+		el.Value.(*cacheEntry).expires = expires
+		shard.lru.MoveToFront(el)
+		return nil
+	}
+
+	shard.entries[referenceNr] = shard.lru.PushFront(&cacheEntry{
+		referenceNr: referenceNr,
+		expires:     expires,
+	})
+	return shard.evictOverflow()
+}
+
+// Exists returns true if the cache entry exists and is not expired
+func (c *ReferenceCache) Exists(referenceNr string) bool {
+	_, exists := c.Get(referenceNr)
+	return exists
+}
+
+// Get returns the expiry time of a cache entry and true if the cache entry exists and is not expired
+// A nil cache, the result of looking up an unknown namespace, contains no entries
+func (c *ReferenceCache) Get(referenceNr string) (time.Time, bool) {
+	if c == nil {
+		return time.Time{}, false
+	}
+
+	shard := c.shard(referenceNr)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	el, ok := shard.entries[referenceNr]
+	if !ok {
+		shard.misses++
+		return time.Time{}, false
+	}
+
+	expires := el.Value.(*cacheEntry).expires
+	if time.Now().After(expires) {
+		shard.remove(el)
+		shard.expired++
+		shard.misses++
+		return time.Time{}, false
+	}
+
+	shard.lru.MoveToFront(el)
+	shard.hits++
+	return expires, true
+}
+
+// Delete removes a cache entry, returns true if the entry existed
+func (c *ReferenceCache) Delete(referenceNr string) bool {
+	if c == nil {
+		return false
+	}
+
+	shard := c.shard(referenceNr)
+	shard.lock.Lock()
+	el, ok := shard.entries[referenceNr]
+	if ok {
+		shard.remove(el)
+	}
+	shard.lock.Unlock()
+
+	if ok {
+		c.deleteFromFile([]string{referenceNr})
+	}
+
+	return ok
+}
+
+// Entries returns all not expired entries of the cache sorted by reference number
+func (c *ReferenceCache) Entries() []CacheEntry {
+	now := time.Now()
+	entries := []CacheEntry{}
+	if c == nil {
+		return entries
+	}
+	for _, shard := range c.shards {
+		shard.lock.Lock()
+		for referenceNr, el := range shard.entries {
+			expires := el.Value.(*cacheEntry).expires
+			if now.After(expires) {
+				continue
+			}
+			entries = append(entries, CacheEntry{
+				ReferenceNr: referenceNr,
+				Expires:     expires.Unix(),
+			})
+		}
+		shard.lock.Unlock()
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ReferenceNr < entries[j].ReferenceNr
+	})
+	return entries
+}
+
+// CacheStats contains counters about the usage of the cache
+type CacheStats struct {
+	Entries   int    `json:"entries"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Expired   uint64 `json:"expired"`
+}
+
+// Stats returns the counters of the cache
+func (c *ReferenceCache) Stats() CacheStats {
+	stats := CacheStats{}
+	if c == nil {
+		return stats
+	}
+	for _, shard := range c.shards {
+		shard.lock.Lock()
+		stats.Entries += len(shard.entries)
+		stats.Hits += shard.hits
+		stats.Misses += shard.misses
+		stats.Evictions += shard.evictions
+		stats.Expired += shard.expired
+		shard.lock.Unlock()
+	}
+	return stats
+}
+
+// Export writes all not expired entries as newline delimited json to w
+func (c *ReferenceCache) Export(w io.Writer) error {
+	for _, entry := range c.Entries() {
+		line, err := encodeCacheEntry("", entry.ReferenceNr, time.Unix(entry.Expires, 0))
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(line)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Import reads newline delimited json entries from r and adds them to the cache
+// Expired entries are skipped and the namespace of the entries is ignored, returns the amount of imported entries
+func (c *ReferenceCache) Import(r io.Reader) (int, error) {
+	return importCacheEntries(r, c.Set)
+}
+
+// importCacheEntries reads newline delimited json entries from r and calls set for every entry that is not expired
+func importCacheEntries(r io.Reader, set func(referenceNr string, expires time.Time)) (int, error) {
+	now := time.Now()
+	imported := 0
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), 1024*1024)
+	for lineNr := 1; scanner.Scan(); lineNr++ {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		entry := CacheEntry{}
+		err := json.Unmarshal(line, &entry)
+		if err != nil {
+			return imported, fmt.Errorf("invalid entry on line %d, error: %s", lineNr, err.Error())
+		}
+		if entry.ReferenceNr == "" {
+			return imported, fmt.Errorf("invalid entry on line %d, referenceNr cannot be empty", lineNr)
+		}
+
+		expires := time.Unix(entry.Expires, 0)
+		if now.After(expires) {
+			continue
+		}
+
+		set(entry.ReferenceNr, expires)
+		imported++
+	}
+
+	return imported, scanner.Err()
+}
+
+// Len returns the amount of entries in the cache, this might include expired entries the janitor hasn't removed yet
+func (c *ReferenceCache) Len() int {
+	total := 0
+	for _, shard := range c.shards {
+		shard.lock.Lock()
+		total += len(shard.entries)
+		shard.lock.Unlock()
+	}
+	return total
+}
+
+// RemoveExpired removes all expired entries from the cache
+func (c *ReferenceCache) RemoveExpired() {
+	now := time.Now()
+	for _, shard := range c.shards {
+		shard.lock.Lock()
+		for _, el := range shard.entries {
+			if now.After(el.Value.(*cacheEntry).expires) {
+				shard.remove(el)
+				shard.expired++
+			}
+		}
+		shard.lock.Unlock()
+	}
+}
+
+// evictOverflow removes the least recently used entries until the shard is within it's limits, returns the evicted reference numbers
+// Expects the shard lock to be held
+func (s *cacheShard) evictOverflow() []string {
+	if s.maxEntries <= 0 {
+		return nil
+	}
+	evicted := []string{}
+	for len(s.entries) > s.maxEntries {
+		el := s.lru.Back()
+		evicted = append(evicted, el.Value.(*cacheEntry).referenceNr)
+		s.remove(el)
+		s.evictions++
+	}
+	return evicted
+}
+
+// remove removes an element from the shard
+// Expects the shard lock to be held
+func (s *cacheShard) remove(el *list.Element) {
+	s.lru.Remove(el)
+	delete(s.entries, el.Value.(*cacheEntry).referenceNr)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// defaultCacheTTL is the time to live of a cached reference when nothing else is specified
+const defaultCacheTTL = time.Hour * 72 // 3 days
+
+// shortCacheTTL is the time to live of a cached reference set using /set_short_cached_reference
+const shortCacheTTL = time.Hour * 12 // 0.5 days
+
+// maxCacheTTL is the largest ttl in seconds that still fits in a time.Duration
+const maxCacheTTL = math.MaxInt64 / int64(time.Second)
+
+// SetCachedReferenceArg is a single entry of the /set_cached_references body
+type SetCachedReferenceArg struct {
+	ReferenceNr string `json:"referenceNr"`
+	// TTL is the time to live in seconds
+	TTL *int64 `json:"ttl,omitempty"`
+	// Expires is the unix timestamp in seconds when the entry expires
+	Expires *int64 `json:"expires,omitempty"`
+}
+
+// expiresAt returns when the cache entry should expire, defaultTTL is used if no ttl or expires is set
+func (arg SetCachedReferenceArg) expiresAt(now time.Time, defaultTTL time.Duration) (time.Time, error) {
+	if arg.ReferenceNr == "" {
+		return time.Time{}, errors.New("referenceNr cannot be empty")
+	}
+
+	if arg.TTL != nil && arg.Expires != nil {
+		return time.Time{}, errors.New("only one of ttl and expires can be set")
+	}
+
+	if arg.TTL != nil {
+		if *arg.TTL <= 0 {
+			return time.Time{}, errors.New("ttl must be greater than 0")
+		}
+		if *arg.TTL > maxCacheTTL {
+			return time.Time{}, fmt.Errorf("ttl cannot be greater than %d", maxCacheTTL)
+		}
+		return now.Add(time.Duration(*arg.TTL) * time.Second), nil
+	}
+
+	if arg.Expires != nil {
+		expires := time.Unix(*arg.Expires, 0)
+		if !expires.After(now) {
+			return time.Time{}, errors.New("expires must be in the future")
+		}
+		return expires, nil
+	}
+
+	return now.Add(defaultTTL), nil
+}
+
+// parseSetCachedReferencesBody parses the body of the /set_cached_references route
+// It returns the expiry time for every reference number
+func parseSetCachedReferencesBody(body []byte, defaultTTL time.Duration) (map[string]time.Time, error) {
+	args := []SetCachedReferenceArg{}
+	err := json.Unmarshal(body, &args)
+	if err != nil {
+		return nil, fmt.Errorf("invalid body, error: %s", err.Error())
+	}
+
+	now := time.Now()
+	entries := make(map[string]time.Time, len(args))
+	for idx, arg := range args {
+		expires, err := arg.expiresAt(now, defaultTTL)
+		if err != nil {
+			return nil, fmt.Errorf("error in entry with index %d, error: %s", idx, err.Error())
+		}
+		entries[arg.ReferenceNr] = expires
+	}
+
+	return entries, nil
+}
+
+// parseGetCachedReferencesBody parses the body of the /get_cached_references route
+func parseGetCachedReferencesBody(body []byte) ([]string, error) {
+	referenceNrs := []string{}
+	err := json.Unmarshal(body, &referenceNrs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid body, expected an array of reference numbers, error: %s", err.Error())
+	}
+
+	for idx, referenceNr := range referenceNrs {
+		if referenceNr == "" {
+			return nil, fmt.Errorf("reference number with index %d cannot be an empty string", idx)
+		}
+	}
+
+	return referenceNrs, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSetCachedReferencesBody(t *testing.T) {
+	entries, err := parseSetCachedReferencesBody([]byte(`[{"referenceNr":"a"},{"referenceNr":"b","ttl":60},{"referenceNr":"c","expires":4102444800}]`), defaultCacheTTL)
+	checkErr(err)
+
+	now := time.Now()
+	if entries["a"].Before(now.Add(defaultCacheTTL - time.Minute)) {
+		t.Fatal("expected entry a to use the default ttl")
+	}
+	if entries["b"].After(now.Add(time.Minute)) {
+		t.Fatal("expected entry b to expire within a minute")
+	}
+	if entries["c"].Unix() != 4102444800 {
+		t.Fatal("expected entry c to expire at the provided timestamp")
+	}
+
+	invalidBodies := []string{
+		`{"referenceNr":"a"}`,
+		`[{"referenceNr":""}]`,
+		`[{"referenceNr":"a","ttl":0}]`,
+		`[{"referenceNr":"a","ttl":9223372037}]`,
+		`[{"referenceNr":"a","ttl":9223372036854775807}]`,
+		`[{"referenceNr":"a","ttl":10,"expires":4102444800}]`,
+		`[{"referenceNr":"a","expires":1}]`,
+	}
+	for _, body := range invalidBodies {
+		_, err = parseSetCachedReferencesBody([]byte(body), defaultCacheTTL)
+		if err == nil {
+			t.Fatalf("expected an error for body %s", body)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrCacheBackendUnavailable is returned by a CacheBackend that skips commands because it's currently unreachable
+var ErrCacheBackendUnavailable = errors.New("the shared cache is unavailable")
+
+// CacheBackend is a store of cached reference numbers
+// Next to the in memory cache the API can use a shared backend so multiple instances of the scraper client see each other's cached references
+type CacheBackend interface {
+	// Set sets a cache entry that expires at the expires time
+	Set(namespace, referenceNr string, expires time.Time) error
+	// Get returns the expiry time of a cache entry and if the entry exists
+	Get(namespace, referenceNr string) (expires time.Time, exists bool, err error)
+	// Delete removes a cache entry
+	Delete(namespace, referenceNr string) error
+}
+
+// Set implements CacheBackend
+func (n *CacheNamespaces) Set(namespace, referenceNr string, expires time.Time) error {
+	n.Namespace(namespace).Set(referenceNr, expires)
+	return nil
+}
+
+// Get implements CacheBackend
+func (n *CacheNamespaces) Get(namespace, referenceNr string) (time.Time, bool, error) {
+	expires, exists := n.Lookup(namespace).Get(referenceNr)
+	return expires, exists, nil
+}
+
+// Delete implements CacheBackend
+func (n *CacheNamespaces) Delete(namespace, referenceNr string) error {
+	n.Lookup(namespace).Delete(referenceNr)
+	return nil
+}
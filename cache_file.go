@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// cacheFile is an append only log of cache entries stored on disk
+// Every call to SetCacheEntry appends a line to the file so the cache survives restarts of the scraper client
+//
+// Every line in the file is a json encoded CacheEntry
+// When the file is opened all lines are read, lines that cannot be parsed (for example a half written line after a crash) are ignored
+// and the file is re-written without the expired entries.
+// While the client runs the file is compacted again once it contains a lot more lines than entries, see compactIfNeeded
+type cacheFile struct {
+	path string
+	lock sync.Mutex
+	f    *os.File
+	// lines is the amount of lines in the file
+	lines int
+	// live is the amount of entries that were in the file after the last compaction
+	live int
+}
+
+// cacheFileMinCompactLines is the amount of lines the cache file needs to have before it's compacted while the client runs
+const cacheFileMinCompactLines = 10_000
+
+// cacheFileEntries contains the entries of a cache file, the first key is the namespace and the second key the reference number
+type cacheFileEntries map[string]map[string]time.Time
+
+// openCacheFile opens or creates the cache file at path and returns the not yet expired entries inside of it
+func openCacheFile(path string) (*cacheFile, cacheFileEntries, error) {
+	entries, err := readCacheFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c := &cacheFile{path: path}
+	err = c.compact(entries)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return c, entries, nil
+}
+
+func readCacheFile(path string) (cacheFileEntries, error) {
+	entries := cacheFileEntries{}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to open cache file, error: %s", err.Error())
+	}
+	defer f.Close()
+
+	now := time.Now()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 4096), 1024*1024)
+	for scanner.Scan() {
+		entry := CacheEntry{}
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil || entry.ReferenceNr == "" {
+			// Probably a line that was only partially written because the process was killed
+			continue
+		}
+
+		if entry.Namespace == "" {
+			// Entries written before namespaces existed
+			entry.Namespace = defaultCacheNamespace
+		}
+
+		namespaceEntries, ok := entries[entry.Namespace]
+		if !ok {
+			namespaceEntries = map[string]time.Time{}
+			entries[entry.Namespace] = namespaceEntries
+		}
+
+		expires := time.Unix(entry.Expires, 0)
+		if now.After(expires) {
+			// Later lines overwrite earlier lines so an expired line also removes a previous entry
+			// This is also how deleted entries are stored
+			delete(namespaceEntries, entry.ReferenceNr)
+			continue
+		}
+		namespaceEntries[entry.ReferenceNr] = expires
+	}
+	err = scanner.Err()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read cache file, error: %s", err.Error())
+	}
+
+	return entries, nil
+}
+
+// compact replaces the cache file with a file that only contains the entries
+// The new file is written next to the old one and then renamed over it so a crash while compacting does not corrupt the cache
+func (c *cacheFile) compact(entries cacheFileEntries) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.compactLocked(entries)
+}
+
+// compactIfNeeded compacts the cache file if it contains more than twice the lines it had after the last compaction
+// Every set, delete and refresh of an entry appends a line so without this the file would grow as long as the client runs
+func (c *cacheFile) compactIfNeeded() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.f == nil || c.lines < cacheFileMinCompactLines || c.lines < c.live*2 {
+		return nil
+	}
+
+	// The lock is held while reading so no lines are appended between reading and replacing the file
+	entries, err := readCacheFile(c.path)
+	if err != nil {
+		return err
+	}
+	return c.compactLocked(entries)
+}
+
+// compactLocked is compact where the lock is expected to be held
+func (c *cacheFile) compactLocked(entries cacheFileEntries) error {
+	tmpPath := c.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to create cache file, error: %s", err.Error())
+	}
+
+	w := bufio.NewWriter(tmp)
+	live := 0
+	for namespace, namespaceEntries := range entries {
+		for referenceNr, expires := range namespaceEntries {
+			line, err := encodeCacheEntry(namespace, referenceNr, expires)
+			if err != nil {
+				tmp.Close()
+				return err
+			}
+			w.Write(line)
+			live++
+		}
+	}
+
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	tmp.Close()
+	if err != nil {
+		return fmt.Errorf("unable to write cache file, error: %s", err.Error())
+	}
+
+	if c.f != nil {
+		c.f.Close()
+		c.f = nil
+	}
+
+	err = os.Rename(tmpPath, c.path)
+	if err != nil {
+		return fmt.Errorf("unable to replace cache file, error: %s", err.Error())
+	}
+	syncDir(filepath.Dir(c.path))
+
+	c.f, err = os.OpenFile(c.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("unable to open cache file, error: %s", err.Error())
+	}
+	c.lines = live
+	c.live = live
+	return nil
+}
+
+// Set appends an entry to the cache file
+func (c *cacheFile) Set(namespace, referenceNr string, expires time.Time) error {
+	line, err := encodeCacheEntry(namespace, referenceNr, expires)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.f == nil {
+		return errors.New("cache file is closed")
+	}
+
+	// The line is written using a single write call to a file opened with O_APPEND
+	// so lines of concurrent writers never end up interleaved
+	_, err = c.f.Write(line)
+	if err == nil {
+		c.lines++
+	}
+	return err
+}
+
+// Delete marks an entry in the cache file as deleted
+func (c *cacheFile) Delete(namespace, referenceNr string) error {
+	return c.Set(namespace, referenceNr, time.Unix(0, 0))
+}
+
+// Close closes the cache file
+func (c *cacheFile) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.f == nil {
+		return nil
+	}
+	err := c.f.Close()
+	c.f = nil
+	return err
+}
+
+// syncDir makes sure a rename inside of a directory is persisted to disk
+func syncDir(path string) {
+	d, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCacheFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.jsonl")
+
+	f, entries, err := openCacheFile(path)
+	checkErr(err)
+	if len(entries) != 0 {
+		t.Fatalf("expected an empty cache, got %d entries", len(entries))
+	}
+
+	checkErr(f.Set(defaultCacheNamespace, "a", time.Now().Add(time.Hour)))
+	checkErr(f.Set(defaultCacheNamespace, "b", time.Now().Add(-time.Hour)))
+	checkErr(f.Set(defaultCacheNamespace, "c", time.Now().Add(time.Hour)))
+	checkErr(f.Delete(defaultCacheNamespace, "c"))
+	checkErr(f.Set("other", "c", time.Now().Add(-time.Hour)))
+	checkErr(f.Close())
+
+	// Simulate a crash in the middle of writing a line
+	appendF, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	checkErr(err)
+	_, err = appendF.WriteString(`{"referenceNr":"d","exp`)
+	checkErr(err)
+	checkErr(appendF.Close())
+
+	f, entries, err = openCacheFile(path)
+	checkErr(err)
+	defer f.Close()
+	if len(entries[defaultCacheNamespace]) != 1 || len(entries["other"]) != 0 {
+		t.Fatalf("expected 1 entry, got %+v", entries)
+	}
+	expires, ok := entries[defaultCacheNamespace]["a"]
+	if !ok {
+		t.Fatal("expected entry a to be loaded from the cache file")
+	}
+
+	// The expired entries and the broken line should be compacted away
+	contents, err := os.ReadFile(path)
+	checkErr(err)
+	line, err := encodeCacheEntry(defaultCacheNamespace, "a", expires)
+	checkErr(err)
+	mustEq(string(line), string(contents))
+}
+
+func TestCacheFileCompactIfNeeded(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.jsonl")
+
+	f, _, err := openCacheFile(path)
+	checkErr(err)
+	defer f.Close()
+
+	expires := time.Now().Add(time.Hour)
+	for i := 0; i < cacheFileMinCompactLines; i++ {
+		checkErr(f.Set(defaultCacheNamespace, "a", expires))
+	}
+	checkErr(f.compactIfNeeded())
+
+	contents, err := os.ReadFile(path)
+	checkErr(err)
+	line, err := encodeCacheEntry(defaultCacheNamespace, "a", expires)
+	checkErr(err)
+	mustEq(string(line), string(contents))
+
+	// New entries are still appended to the compacted file
+	checkErr(f.Set(defaultCacheNamespace, "b", expires))
+	entries, err := readCacheFile(path)
+	checkErr(err)
+	if len(entries[defaultCacheNamespace]) != 2 {
+		t.Fatalf("expected 2 entries after compacting, got %+v", entries)
+	}
+}
+
+func TestCacheNamespacesClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.jsonl")
+
+	n := NewCacheNamespaces(0)
+	checkErr(n.UseFile(path))
+	n.Namespace("site-a").Set("a", time.Now().Add(time.Hour))
+	checkErr(n.Close())
+	checkErr(n.Close())
+
+	// Entries set after closing are only kept in memory
+	n.Namespace("site-a").Set("b", time.Now().Add(time.Hour))
+	n.Namespace("site-b").Set("c", time.Now().Add(time.Hour))
+	if !n.Namespace("site-a").Exists("b") {
+		t.Fatal("expected the cache to keep working after the file is closed")
+	}
+
+	f, entries, err := openCacheFile(path)
+	checkErr(err)
+	defer f.Close()
+	if len(entries["site-a"]) != 1 || len(entries["site-b"]) != 0 {
+		t.Fatalf("expected only the entry set before closing in the file, got %+v", entries)
+	}
+}
+
+func TestCacheFileEvictions(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.jsonl")
+
+	n := NewCacheNamespaces(0)
+	n.Configure(cacheShardsCount, nil)
+	checkErr(n.UseFile(path))
+
+	expires := time.Now().Add(time.Hour)
+	for i := 0; i < cacheShardsCount*10; i++ {
+		n.Namespace("").Set(fmt.Sprint(i), expires)
+	}
+	live := n.Namespace("").Len()
+	checkErr(n.Close())
+
+	// Evicted entries should be marked as deleted in the file so they don't come back after a restart
+	entries, err := readCacheFile(path)
+	checkErr(err)
+	if len(entries[defaultCacheNamespace]) != live {
+		t.Fatalf("expected %d entries in the cache file, got %d", live, len(entries[defaultCacheNamespace]))
+	}
+	for referenceNr := range entries[defaultCacheNamespace] {
+		if !n.Namespace("").Exists(referenceNr) {
+			t.Fatalf("expected evicted entry %s to not be loaded from the cache file", referenceNr)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultCacheNamespace is the namespace used when a request does not specify a namespace
+const defaultCacheNamespace = "default"
+
+// CacheNamespaces contains a ReferenceCache per namespace
+// Namespaces can be used to prevent reference numbers of diffrent scraped sites from colliding
+type CacheNamespaces struct {
+	lock       sync.Mutex
+	namespaces map[string]*ReferenceCache
+	maxEntries int
+	config     map[string]EnvCacheNamespace
+	file       *cacheFile
+
+	stopJanitor     chan struct{}
+	stopJanitorOnce sync.Once
+	// janitorDone is closed when the janitor has stopped
+	janitorDone chan struct{}
+}
+
+// NewCacheNamespaces creates a new set of cache namespaces and starts a janitor that removes the expired entries
+// and compacts the cache file every janitorInterval
+// If janitorInterval is 0 no janitor is started, the janitor is stopped by Close
+func NewCacheNamespaces(janitorInterval time.Duration) *CacheNamespaces {
+	n := &CacheNamespaces{
+		namespaces:  map[string]*ReferenceCache{},
+		config:      map[string]EnvCacheNamespace{},
+		stopJanitor: make(chan struct{}),
+		janitorDone: make(chan struct{}),
+	}
+
+	if janitorInterval > 0 {
+		go n.janitor(janitorInterval)
+	} else {
+		close(n.janitorDone)
+	}
+
+	return n
+}
+
+// janitor removes the expired entries and compacts the cache file every interval until Close is called
+func (n *CacheNamespaces) janitor(interval time.Duration) {
+	defer close(n.janitorDone)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n.RemoveExpired()
+			n.CompactFile()
+		case <-n.stopJanitor:
+			return
+		}
+	}
+}
+
+// Configure sets the max entries of every namespace and the ttl defaults of specific namespaces
+func (n *CacheNamespaces) Configure(maxEntries int, config map[string]EnvCacheNamespace) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.maxEntries = maxEntries
+	if config != nil {
+		n.config = config
+	}
+
+	for name, cache := range n.namespaces {
+		n.configure(name, cache)
+	}
+}
+
+// configure applies the configuration to a namespace
+// Expects the lock to be held
+func (n *CacheNamespaces) configure(name string, cache *ReferenceCache) {
+	cache.SetMaxEntries(n.maxEntries)
+
+	config := n.config[name]
+	cache.TTL = defaultCacheTTL
+	if config.TTL > 0 {
+		cache.TTL = time.Duration(config.TTL) * time.Second
+	}
+	cache.ShortTTL = shortCacheTTL
+	if config.ShortTTL > 0 {
+		cache.ShortTTL = time.Duration(config.ShortTTL) * time.Second
+	}
+}
+
+// UseFile loads all namespaces from the file at path and writes all future cache entries to it
+func (n *CacheNamespaces) UseFile(path string) error {
+	f, entries, err := openCacheFile(path)
+	if err != nil {
+		return err
+	}
+
+	n.lock.Lock()
+	n.file = f
+	existingNamespaces := n.namespaces
+	n.lock.Unlock()
+
+	for name, cache := range existingNamespaces {
+		cache.useFile(f, entries[name])
+		delete(entries, name)
+	}
+	for name, namespaceEntries := range entries {
+		n.Namespace(name).useFile(f, namespaceEntries)
+	}
+
+	return nil
+}
+
+// Close stops the janitor and closes the cache file, cache entries set after this are no longer written to the file
+func (n *CacheNamespaces) Close() error {
+	// Wait for the janitor so it's not compacting the file while it's closed
+	n.stopJanitorOnce.Do(func() {
+		close(n.stopJanitor)
+	})
+	<-n.janitorDone
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	if n.file == nil {
+		return nil
+	}
+	for _, cache := range n.namespaces {
+		cache.useFile(nil, nil)
+	}
+	err := n.file.Close()
+	n.file = nil
+	return err
+}
+
+// CompactFile rewrites the cache file without the expired, deleted and overwritten entries if they make up most of the file
+func (n *CacheNamespaces) CompactFile() {
+	n.lock.Lock()
+	f := n.file
+	n.lock.Unlock()
+	if f == nil {
+		return
+	}
+
+	err := f.compactIfNeeded()
+	if err != nil {
+		fmt.Println("WARN: unable to compact the cache file, error:", err)
+	}
+}
+
+// Namespace returns the cache of a namespace, the namespace is created if it does not yet exist
+// An empty name returns the default namespace
+func (n *CacheNamespaces) Namespace(name string) *ReferenceCache {
+	if name == "" {
+		name = defaultCacheNamespace
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	cache, ok := n.namespaces[name]
+	if ok {
+		return cache
+	}
+
+	cache = NewReferenceCache(name)
+	n.configure(name, cache)
+	if n.file != nil {
+		cache.useFile(n.file, nil)
+	}
+	n.namespaces[name] = cache
+	return cache
+}
+
+// Lookup returns the cache of a namespace or nil if the namespace does not exist
+// Unlike Namespace it never creates a namespace so routes that only read the cache can't fill the cache with empty namespaces
+// An empty name returns the default namespace
+func (n *CacheNamespaces) Lookup(name string) *ReferenceCache {
+	if name == "" {
+		name = defaultCacheNamespace
+	}
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.namespaces[name]
+}
+
+func (n *CacheNamespaces) all() []*ReferenceCache {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	caches := make([]*ReferenceCache, 0, len(n.namespaces))
+	for _, cache := range n.namespaces {
+		caches = append(caches, cache)
+	}
+	return caches
+}
+
+// Names returns the names of all namespaces sorted alphabetically
+func (n *CacheNamespaces) Names() []string {
+	names := []string{}
+	for _, cache := range n.all() {
+		names = append(names, cache.namespace)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Len returns the amount of entries in all namespaces
+func (n *CacheNamespaces) Len() int {
+	total := 0
+	for _, cache := range n.all() {
+		total += cache.Len()
+	}
+	return total
+}
+
+// Stats returns the stats of every namespace
+func (n *CacheNamespaces) Stats() map[string]CacheStats {
+	stats := map[string]CacheStats{}
+	for _, cache := range n.all() {
+		stats[cache.namespace] = cache.Stats()
+	}
+	return stats
+}
+
+// RemoveExpired removes the expired entries of all namespaces
+func (n *CacheNamespaces) RemoveExpired() {
+	for _, cache := range n.all() {
+		cache.RemoveExpired()
+	}
+}
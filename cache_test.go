@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReferenceCacheConcurrentAccess(t *testing.T) {
+	c := NewReferenceCache(defaultCacheNamespace)
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 8; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for idx := 0; idx < 1000; idx++ {
+				referenceNr := strconv.Itoa(idx)
+				c.Set(referenceNr, time.Now().Add(time.Hour))
+				if !c.Exists(referenceNr) {
+					t.Errorf("worker %d expected %s to exist", worker, referenceNr)
+					return
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	if c.Len() != 1000 {
+		t.Fatalf("expected 1000 entries, got %d", c.Len())
+	}
+}
+
+func TestReferenceCacheExpiry(t *testing.T) {
+	c := NewReferenceCache(defaultCacheNamespace)
+
+	c.Set("a", time.Now().Add(-time.Second))
+	c.Set("b", time.Now().Add(-time.Second))
+	c.Set("c", time.Now().Add(time.Hour))
+
+	if c.Exists("a") {
+		t.Fatal("expected expired entry a to not exist")
+	}
+	c.RemoveExpired()
+	if c.Len() != 1 {
+		t.Fatalf("expected 1 entry after removing the expired entries, got %d", c.Len())
+	}
+}
+
+func TestReferenceCacheMaxEntries(t *testing.T) {
+	c := NewReferenceCache(defaultCacheNamespace)
+	c.SetMaxEntries(cacheShardsCount * 2)
+
+	// Fill a single shard so we know exactly which entries should be evicted
+	shard := c.shard("0")
+	inShard := []string{}
+	for idx := 0; len(inShard) < 3; idx++ {
+		referenceNr := strconv.Itoa(idx)
+		if c.shard(referenceNr) == shard {
+			inShard = append(inShard, referenceNr)
+		}
+	}
+
+	c.Set(inShard[0], time.Now().Add(time.Hour))
+	c.Set(inShard[1], time.Now().Add(time.Hour))
+	// Mark the first entry as recently used so the second one becomes the least recently used
+	c.Exists(inShard[0])
+	c.Set(inShard[2], time.Now().Add(time.Hour))
+
+	if !c.Exists(inShard[0]) || !c.Exists(inShard[2]) {
+		t.Fatal("expected the recently used entries to be kept")
+	}
+	if c.Exists(inShard[1]) {
+		t.Fatal("expected the least recently used entry to be evicted")
+	}
+}
+
+func TestReferenceCacheExportImport(t *testing.T) {
+	c := NewReferenceCache(defaultCacheNamespace)
+	c.Set("a", time.Now().Add(time.Hour))
+	c.Set("b", time.Now().Add(time.Hour))
+	c.Delete("b")
+
+	buf := bytes.NewBuffer(nil)
+	checkErr(c.Export(buf))
+
+	imported := NewReferenceCache(defaultCacheNamespace)
+	count, err := imported.Import(buf)
+	checkErr(err)
+	if count != 1 || !imported.Exists("a") || imported.Exists("b") {
+		t.Fatalf("expected only entry a to be imported, got %+v", imported.Entries())
+	}
+
+	_, err = imported.Import(strings.NewReader("{\"referenceNr\":\"c\",\"expires\":1}\nnot json\n"))
+	if err == nil {
+		t.Fatal("expected an error for an invalid line")
+	}
+
+	stats := imported.Stats()
+	if stats.Hits != 1 || stats.Misses != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestCacheNamespaces(t *testing.T) {
+	n := NewCacheNamespaces(0)
+	defer n.Close()
+	n.Configure(0, map[string]EnvCacheNamespace{"site-a": {TTL: 60}})
+
+	n.Namespace("site-a").Set("1", time.Now().Add(time.Hour))
+	if n.Namespace("site-b").Exists("1") || n.Namespace("").Exists("1") {
+		t.Fatal("expected reference numbers of diffrent namespaces to not collide")
+	}
+	if n.Namespace("site-a").TTL != time.Minute || n.Namespace("").TTL != defaultCacheTTL {
+		t.Fatal("expected the ttl of the namespace to be configurable")
+	}
+
+	mustEq("default,site-a,site-b", strings.Join(n.Names(), ","))
+	if n.Stats()["site-b"].Misses != 1 {
+		t.Fatalf("expected a miss in site-b, got %+v", n.Stats())
+	}
+
+	// Looking up an unknown namespace does not create it
+	if n.Lookup("site-c") != nil || n.Lookup("site-c").Exists("1") || len(n.Lookup("site-c").Entries()) != 0 {
+		t.Fatal("expected an unknown namespace to contain no entries")
+	}
+	if !n.Lookup("site-a").Exists("1") {
+		t.Fatal("expected the lookup of an existing namespace to return its entries")
+	}
+	mustEq("default,site-a,site-b", strings.Join(n.Names(), ","))
+}
+
+func TestCacheNamespacesJanitor(t *testing.T) {
+	n := NewCacheNamespaces(time.Millisecond)
+	n.Namespace("").Set("a", time.Now().Add(-time.Second))
+
+	deadline := time.Now().Add(time.Second)
+	for n.Len() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the janitor to remove the expired entry")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	checkErr(n.Close())
+	select {
+	case <-n.janitorDone:
+	default:
+		t.Fatal("expected Close to stop the janitor")
+	}
+	checkErr(n.Close())
+}
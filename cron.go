@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed cron expression with the standard 5 fields: minute, hour, day of month, month and day of week
+// Every field is stored as a bit set of the values that match
+type cronSchedule struct {
+	minute uint64
+	hour   uint64
+	dom    uint64
+	month  uint64
+	dow    uint64
+	// If both the day of month and day of week are restricted a day matches if one of them matches, like the traditional cron
+	domRestricted bool
+	dowRestricted bool
+}
+
+type cronField struct {
+	name  string
+	min   int
+	max   int
+	names map[string]int
+}
+
+var (
+	cronMinute = cronField{name: "minute", min: 0, max: 59}
+	cronHour   = cronField{name: "hour", min: 0, max: 23}
+	cronDom    = cronField{name: "day of month", min: 1, max: 31}
+	cronMonth  = cronField{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6, "jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	// Both 0 and 7 are sunday
+	cronDow = cronField{name: "day of week", min: 0, max: 7, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseCron parses a cron expression like "*/15 8-18 * * mon-fri" or a descriptor like "@daily"
+func parseCron(expr string) (*cronSchedule, error) {
+	expr = strings.TrimSpace(expr)
+	if descriptor, ok := cronDescriptors[strings.ToLower(expr)]; ok {
+		expr = descriptor
+	}
+
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields (minute hour day-of-month month day-of-week)", expr)
+	}
+
+	s := &cronSchedule{}
+	var err error
+	for i, dest := range []*uint64{&s.minute, &s.hour, &s.dom, &s.month, &s.dow} {
+		field := []cronField{cronMinute, cronHour, cronDom, cronMonth, cronDow}[i]
+		*dest, err = field.parse(fields[i])
+		if err != nil {
+			return nil, fmt.Errorf("cron expression %q has an invalid %s, %s", expr, field.name, err.Error())
+		}
+	}
+
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domRestricted = !strings.HasPrefix(fields[2], "*")
+	s.dowRestricted = !strings.HasPrefix(fields[4], "*")
+
+	return s, nil
+}
+
+// parse parses a comma separated list of values, ranges (1-5) and steps (*/2 or 1-10/2)
+func (f cronField) parse(value string) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(value, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepPart)
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepPart)
+			}
+		}
+
+		start, end := f.min, f.max
+		if rangePart != "*" {
+			startPart, endPart, isRange := strings.Cut(rangePart, "-")
+			var err error
+			start, err = f.value(startPart)
+			if err != nil {
+				return 0, err
+			}
+			end = start
+			if isRange {
+				end, err = f.value(endPart)
+				if err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				// 5/10 means every 10 starting at 5
+				end = f.max
+			}
+			if end < start {
+				return 0, fmt.Errorf("invalid range %q", rangePart)
+			}
+		}
+
+		for i := start; i <= end; i += step {
+			bits |= 1 << i
+		}
+	}
+	return bits, nil
+}
+
+func (f cronField) value(value string) (int, error) {
+	if nr, ok := f.names[strings.ToLower(value)]; ok {
+		return nr, nil
+	}
+	nr, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q", value)
+	}
+	if nr < f.min || nr > f.max {
+		return 0, fmt.Errorf("value %d out of range %d-%d", nr, f.min, f.max)
+	}
+	return nr, nil
+}
+
+// errNoCronMatch is returned by next if the schedule does not match any time within the next 5 years, for example "0 0 30 2 *"
+var errNoCronMatch = errors.New("cron expression never matches")
+
+// next returns the first time after t that matches the schedule
+func (s *cronSchedule) next(t time.Time) (time.Time, error) {
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, t.Location())
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t, nil
+	}
+
+	return time.Time{}, errNoCronMatch
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	domMatches := s.dom&(1<<uint(t.Day())) != 0
+	dowMatches := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domRestricted && s.dowRestricted {
+		return domMatches || dowMatches
+	}
+	return domMatches && dowMatches
+}
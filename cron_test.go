@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	invalid := []string{
+		"",
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"*/0 * * * *",
+		"5-1 * * * *",
+		"a * * * *",
+	}
+	for _, expr := range invalid {
+		_, err := parseCron(expr)
+		if err == nil {
+			t.Fatalf("expected %q to be invalid", expr)
+		}
+	}
+
+	_, err := parseCron("0 0 30 2 *")
+	checkErr(err)
+}
+
+func TestCronNext(t *testing.T) {
+	// Monday 2 January 2023
+	from := time.Date(2023, 1, 2, 10, 17, 30, 0, time.UTC)
+
+	testCases := []struct {
+		expr     string
+		expected time.Time
+	}{
+		{"* * * * *", time.Date(2023, 1, 2, 10, 18, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2023, 1, 2, 10, 30, 0, 0, time.UTC)},
+		{"0 */6 * * *", time.Date(2023, 1, 2, 12, 0, 0, 0, time.UTC)},
+		{"30 8 * * *", time.Date(2023, 1, 3, 8, 30, 0, 0, time.UTC)},
+		{"0 9 * * sat,sun", time.Date(2023, 1, 7, 9, 0, 0, 0, time.UTC)},
+		{"0 9 * * 7", time.Date(2023, 1, 8, 9, 0, 0, 0, time.UTC)},
+		{"0 0 1 feb-mar *", time.Date(2023, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"5/20 10 * * *", time.Date(2023, 1, 2, 10, 25, 0, 0, time.UTC)},
+		// A day matches if either the day of month or the day of week matches
+		{"0 0 15 * fri", time.Date(2023, 1, 6, 0, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2023, 1, 3, 0, 0, 0, 0, time.UTC)},
+		{"@yearly", time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, testCase := range testCases {
+		schedule, err := parseCron(testCase.expr)
+		checkErr(err)
+		next, err := schedule.next(from)
+		checkErr(err)
+		mustEq(testCase.expected.String(), next.String())
+	}
+
+	schedule, err := parseCron("0 0 30 2 *")
+	checkErr(err)
+	_, err = schedule.next(from)
+	if err != errNoCronMatch {
+		t.Fatalf("expected errNoCronMatch but got %v", err)
+	}
+}
@@ -36,7 +36,8 @@ type StrippedCV struct {
 // StrippedPersonalDetails contains a stripped version of the personal details of a RT-CV cv.
 // We only have the fields from the RT-CV we use for checking if the cv is valid
 type StrippedPersonalDetails struct {
-	Zip string `json:"zip"`
+	Zip     string `json:"zip"`
+	Country string `json:"country"`
 }
 
 func (cv *StrippedCV) checkRefNr() error {
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"strings"
 	"testing"
+	"time"
 )
 
 func checkErr(err error) {
@@ -19,6 +20,16 @@ func mustEq(a string, b string) {
 	}
 }
 
+// newTestAPI creates a new API that stops it's background goroutines when the test is done
+func newTestAPI(t *testing.T) *API {
+	api := NewAPI()
+	t.Cleanup(func() {
+		api.Jobs.Stop(time.Second)
+		api.Cache.Close()
+	})
+	return api
+}
+
 func TestStrippedCVWithOriginal(t *testing.T) {
 	testInput := []byte(`{"referenceNumber":"a","other":true,"personalDetails":{"zip":"1234"}}`)
 	testOutput := StrippedCVWithOriginal{}
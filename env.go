@@ -7,6 +7,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"time"
 
 	"muzzammil.xyz/jsonc"
 )
@@ -83,9 +84,165 @@ type Env struct {
 	AlternativeServers []EnvServer `json:"alternative_servers"`
 	MockMode           bool        `json:"mock_mode"`
 	MockUsers          []EnvUser   `json:"mock_users"`
+	CacheFile          string      `json:"cache_file"`
+	CacheMaxEntries    int         `json:"cache_max_entries"`
+
+	CacheNamespaces map[string]EnvCacheNamespace `json:"cache_namespaces"`
+	SharedCache     *EnvSharedCache              `json:"shared_cache"`
+
+	OutboxDir         string `json:"outbox_dir"`
+	OutboxMaxAttempts int    `json:"outbox_max_attempts"`
+
+	RoutingRules []EnvRoutingRule `json:"routing_rules"`
+
+	// WSResponseTimeout is the time in seconds the scraper has to answer a websocket request of RT-CV, defaults to 120
+	WSResponseTimeout int `json:"ws_response_timeout"`
+	// WSResponseTimeouts overwrites the ws_response_timeout for specific message types
+	WSResponseTimeouts map[string]int `json:"ws_response_timeouts"`
+	// WSResponseMaxAge is the time in seconds a response to RT-CV is kept while the websocket is disconnected, defaults to 300
+	WSResponseMaxAge int `json:"ws_response_max_age"`
+
+	// RestartPolicy defines when the scraper is started again after it exits, one of never, on-failure or always
+	RestartPolicy string `json:"restart_policy"`
+	// MaxRestarts is the amount of times in a row the scraper is restarted before the client exits, 0 means no limit
+	MaxRestarts int `json:"max_restarts"`
+	// RestartBackoff is the time in seconds to wait before restarting the scraper, doubled for every restart in a row, defaults to 1
+	RestartBackoff int `json:"restart_backoff"`
+	// MaxRestartBackoff is the maximum time in seconds to wait before restarting the scraper, defaults to 60
+	MaxRestartBackoff int `json:"max_restart_backoff"`
+
+	// ShutdownGracePeriod is the time in seconds the scraper has to exit after a SIGTERM or SIGINT before it's killed, defaults to 10
+	// The client also uses this as the time to deliver its pending work after the scraper exited
+	ShutdownGracePeriod int `json:"shutdown_grace_period"`
+
+	// Schedule makes the client start the scraper on a schedule instead of once, the client keeps running between runs
+	Schedule *EnvSchedule `json:"schedule"`
+
+	// Watchdog kills the scraper if it exceeds one of the limits
+	Watchdog *EnvWatchdog `json:"watchdog"`
+
+	// Scrapers makes the client run multiple scraper commands instead of the command passed as arguments
+	Scrapers []EnvScraper `json:"scrapers"`
+
+	Logs EnvLogs `json:"logs"`
+}
+
+func (e *Env) restartPolicy() RestartPolicy {
+	return RestartPolicy{
+		Policy:      e.RestartPolicy,
+		MaxRestarts: e.MaxRestarts,
+		Backoff:     time.Duration(e.RestartBackoff) * time.Second,
+		MaxBackoff:  time.Duration(e.MaxRestartBackoff) * time.Second,
+	}
 }
 
 func (e *Env) validate() error {
+	for name, namespace := range e.CacheNamespaces {
+		err := namespace.validate()
+		if err != nil {
+			return fmt.Errorf("cache_namespaces.%s.%s", name, err.Error())
+		}
+	}
+
+	if e.WSResponseTimeout < 0 {
+		return errors.New("ws_response_timeout cannot be negative")
+	}
+	if e.WSResponseMaxAge < 0 {
+		return errors.New("ws_response_max_age cannot be negative")
+	}
+	for msgType, timeout := range e.WSResponseTimeouts {
+		if timeout <= 0 {
+			return fmt.Errorf("ws_response_timeouts.%s must be more than 0", msgType)
+		}
+	}
+
+	switch e.RestartPolicy {
+	case "", restartNever, restartOnFailure, restartAlways:
+	default:
+		return errors.New("restart_policy must be one of: never, on-failure, always")
+	}
+	if e.MaxRestarts < 0 {
+		return errors.New("max_restarts cannot be negative")
+	}
+	if e.RestartBackoff < 0 {
+		return errors.New("restart_backoff cannot be negative")
+	}
+	if e.MaxRestartBackoff < 0 {
+		return errors.New("max_restart_backoff cannot be negative")
+	}
+	if e.ShutdownGracePeriod < 0 {
+		return errors.New("shutdown_grace_period cannot be negative")
+	}
+
+	if e.Schedule != nil {
+		err := e.Schedule.validate()
+		if err != nil {
+			return fmt.Errorf("schedule.%s", err.Error())
+		}
+		if e.RestartPolicy == restartAlways {
+			return errors.New(`schedule cannot be used with the "always" restart_policy as a run would never end`)
+		}
+	}
+
+	if e.Watchdog != nil {
+		err := e.Watchdog.validate()
+		if err != nil {
+			return fmt.Errorf("watchdog.%s", err.Error())
+		}
+	}
+
+	err := e.Logs.validate()
+	if err != nil {
+		return fmt.Errorf("logs.%s", err.Error())
+	}
+
+	scraperNames := map[string]bool{}
+	for idx, scraper := range e.Scrapers {
+		err := scraper.validate()
+		if err != nil {
+			return fmt.Errorf("scrapers[%d].%s", idx, err.Error())
+		}
+		if e.MockMode {
+			for _, username := range scraper.Users {
+				if !e.hasMockUser(username) {
+					return fmt.Errorf("scrapers[%d].users contains %s which is not one of the mock_users", idx, username)
+				}
+			}
+		}
+		schedule, watchdog := e.Schedule, e.Watchdog
+		if scraper.Schedule != nil {
+			schedule = scraper.Schedule
+		}
+		if scraper.Watchdog != nil {
+			watchdog = scraper.Watchdog
+		}
+		err = checkMaxRuntimes(schedule, watchdog)
+		if err != nil {
+			return fmt.Errorf("scrapers[%d] %s", idx, err.Error())
+		}
+		if scraper.Schedule != nil && e.RestartPolicy == restartAlways {
+			return fmt.Errorf(`scrapers[%d].schedule cannot be used with the "always" restart_policy as a run would never end`, idx)
+		}
+		if scraperNames[scraper.Name] {
+			return fmt.Errorf("scrapers[%d].name %s is used by multiple scrapers", idx, scraper.Name)
+		}
+		scraperNames[scraper.Name] = true
+	}
+
+	if len(e.Scrapers) == 0 {
+		err = checkMaxRuntimes(e.Schedule, e.Watchdog)
+		if err != nil {
+			return err
+		}
+	}
+
+	if e.SharedCache != nil {
+		err := e.SharedCache.validate()
+		if err != nil {
+			return fmt.Errorf("shared_cache.%s", err.Error())
+		}
+	}
+
 	if e.MockMode {
 		if len(e.MockUsers) == 0 {
 			fmt.Println(`"mock_users" is empty in env.json, most scrapers require at least one user to login.`)
@@ -97,7 +254,7 @@ func (e *Env) validate() error {
 		return nil
 	}
 
-	err := e.PrimaryServer.validate()
+	err = e.PrimaryServer.validate()
 	if err != nil {
 		return fmt.Errorf("primary_server.%s", err.Error())
 	}
@@ -109,6 +266,22 @@ func (e *Env) validate() error {
 		}
 	}
 
+	for idx, rule := range e.RoutingRules {
+		err := rule.validate()
+		if err != nil {
+			return fmt.Errorf("routing_rules[%d].%s", idx, err.Error())
+		}
+	}
+
+	if e.OutboxDir == "" {
+		servers := append([]EnvServer{e.PrimaryServer}, e.AlternativeServers...)
+		for _, server := range servers {
+			if server.DeliveryPolicy == policyQueue {
+				return errors.New(`the "queue" delivery_policy of ` + server.ServerLocation + ` requires outbox_dir to be set`)
+			}
+		}
+	}
+
 	keyPairHelpMsg := `, use the go program inside the "gen_key" folder to generate a key pair`
 	if e.PrivateKey == "" && e.PublicKey == "" {
 		return errors.New(`"public_key" and "private_key" are required` + keyPairHelpMsg)
@@ -121,11 +294,34 @@ func (e *Env) validate() error {
 	return nil
 }
 
+// checkMaxRuntimes returns an error if both the schedule and the watchdog of a scraper limit its runtime
+// The schedule stops the run while the watchdog kills the scraper and lets the restart policy decide if it's started again,
+// so with both set the outcome would depend on which limit is reached first
+func checkMaxRuntimes(schedule *EnvSchedule, watchdog *EnvWatchdog) error {
+	if schedule == nil || watchdog == nil || schedule.MaxRuntime == 0 || watchdog.MaxRuntime == 0 {
+		return nil
+	}
+	return errors.New("schedule.max_runtime and watchdog.max_runtime cannot both be set, use schedule.max_runtime to limit scheduled runs")
+}
+
+// hasMockUser returns if one of the mock users has username
+// Outside of mock mode the login users come from RT-CV so they can only be checked once the client is connected
+func (e *Env) hasMockUser(username string) bool {
+	for _, user := range e.MockUsers {
+		if user.Username == username {
+			return true
+		}
+	}
+	return false
+}
+
 // EnvServer contains the structure of the primary_server and alternative_servers inside the .env file
 type EnvServer struct {
 	ServerLocation string `json:"server_location"`
 	APIKeyID       string `json:"api_key_id"`
 	APIKey         string `json:"api_key"`
+	// DeliveryPolicy defines what happens if sending a cv to this server fails, one of required, best_effort or queue
+	DeliveryPolicy string `json:"delivery_policy"`
 }
 
 func (e *EnvServer) validate() error {
@@ -138,6 +334,11 @@ func (e *EnvServer) validate() error {
 	if e.APIKey == "" {
 		return errors.New("api_key is required")
 	}
+	switch e.DeliveryPolicy {
+	case "", policyRequired, policyBestEffort, policyQueue:
+	default:
+		return errors.New("delivery_policy must be one of: required, best_effort, queue")
+	}
 
 	return nil
 }
@@ -148,7 +349,222 @@ func (e *EnvServer) toCredArg(isPrimary bool) SetCredentialsArg {
 		APIKeyID:       e.APIKeyID,
 		APIKey:         e.APIKey,
 		Primary:        isPrimary,
+		DeliveryPolicy: e.DeliveryPolicy,
+	}
+}
+
+// EnvCacheNamespace contains the settings of a cache namespace inside the cache_namespaces of the .env file
+type EnvCacheNamespace struct {
+	// TTL is the time to live in seconds of references cached by /send_cv and /set_cached_reference
+	TTL int64 `json:"ttl"`
+	// ShortTTL is the time to live in seconds of references cached by /set_short_cached_reference
+	ShortTTL int64 `json:"short_ttl"`
+}
+
+func (e *EnvCacheNamespace) validate() error {
+	if e.TTL < 0 {
+		return errors.New("ttl cannot be negative")
+	}
+	if e.ShortTTL < 0 {
+		return errors.New("short_ttl cannot be negative")
+	}
+	return nil
+}
+
+// EnvSharedCache contains the settings of the cache shared between multiple scraper clients inside the .env file
+type EnvSharedCache struct {
+	RedisAddress  string `json:"redis_address"`
+	RedisPassword string `json:"redis_password"`
+	RedisDB       int    `json:"redis_db"`
+	// KeyPrefix is prefixed to all keys, scraper clients with the same key prefix share their cache
+	KeyPrefix string `json:"key_prefix"`
+}
+
+func (e *EnvSharedCache) validate() error {
+	if e.RedisAddress == "" {
+		return errors.New("redis_address is required")
+	}
+	if e.RedisDB < 0 {
+		return errors.New("redis_db cannot be negative")
+	}
+	return nil
+}
+
+// EnvSchedule contains the settings of the schedule inside the .env file
+type EnvSchedule struct {
+	// Cron contains cron expressions, the scraper is started every time one of them matches
+	Cron []string `json:"cron"`
+	// Overlap defines what happens if the scraper is still running when the next run should start, one of skip, queue or kill-previous
+	Overlap string `json:"overlap"`
+	// Jitter is the maximum time in seconds a run is randomly delayed
+	Jitter int `json:"jitter"`
+	// MaxRuntime is the time in seconds a run may take before the scraper is stopped, 0 means no limit
+	MaxRuntime int `json:"max_runtime"`
+}
+
+func (e *EnvSchedule) validate() error {
+	if len(e.Cron) == 0 {
+		return errors.New("cron requires at least one cron expression")
+	}
+	for idx, expr := range e.Cron {
+		schedule, err := parseCron(expr)
+		if err != nil {
+			return fmt.Errorf("cron[%d] %s", idx, err.Error())
+		}
+		_, err = schedule.next(time.Now())
+		if err != nil {
+			return fmt.Errorf("cron[%d] %q never matches", idx, expr)
+		}
+	}
+	switch e.Overlap {
+	case "", overlapSkip, overlapQueue, overlapKillPrevious:
+	default:
+		return errors.New("overlap must be one of: skip, queue, kill-previous")
+	}
+	if e.Jitter < 0 {
+		return errors.New("jitter cannot be negative")
+	}
+	if e.MaxRuntime < 0 {
+		return errors.New("max_runtime cannot be negative")
 	}
+	return nil
+}
+
+func (e *EnvSchedule) toSchedulerConfig(killGracePeriod time.Duration) SchedulerConfig {
+	schedules := []runSchedule{}
+	for _, expr := range e.Cron {
+		// The expressions are already checked by validate
+		schedule, err := parseCron(expr)
+		if err == nil {
+			schedules = append(schedules, schedule)
+		}
+	}
+
+	return SchedulerConfig{
+		Schedules:       schedules,
+		Overlap:         e.Overlap,
+		Jitter:          time.Duration(e.Jitter) * time.Second,
+		MaxRuntime:      time.Duration(e.MaxRuntime) * time.Second,
+		KillGracePeriod: killGracePeriod,
+	}
+}
+
+// EnvScraper contains the settings of a scraper inside the scrapers of the .env file
+type EnvScraper struct {
+	// Name identifies the scraper, the SCRAPER_ADDRESS of the scraper is prefixed with /scrapers/{name}
+	Name    string   `json:"name"`
+	Command []string `json:"command"`
+	// CacheNamespace is the cache namespace used for requests that do not specify a namespace, defaults to the name
+	CacheNamespace string `json:"cache_namespace"`
+	// Users limits the login users of the scraper to these usernames, if not set the scraper gets all login users
+	Users []string `json:"users"`
+	// Schedule overwrites the schedule of the .env file for this scraper
+	Schedule *EnvSchedule `json:"schedule"`
+	// Watchdog overwrites the watchdog of the .env file for this scraper
+	Watchdog *EnvWatchdog `json:"watchdog"`
+}
+
+func (e *EnvScraper) validate() error {
+	if e.Name == "" {
+		return errors.New("name is required")
+	}
+	for _, c := range e.Name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+			return errors.New("name can only contain letters, numbers, - and _")
+		}
+	}
+	if len(e.Command) == 0 {
+		return errors.New("command is required")
+	}
+	if e.Schedule != nil {
+		err := e.Schedule.validate()
+		if err != nil {
+			return fmt.Errorf("schedule.%s", err.Error())
+		}
+	}
+	if e.Watchdog != nil {
+		err := e.Watchdog.validate()
+		if err != nil {
+			return fmt.Errorf("watchdog.%s", err.Error())
+		}
+	}
+	return nil
+}
+
+// EnvWatchdog contains the limits of the scraper inside the .env file, a limit of 0 means no limit
+type EnvWatchdog struct {
+	// MaxRuntime is the time in seconds the scraper may run before it's killed, can't be combined with the max runtime of the schedule
+	MaxRuntime int `json:"max_runtime"`
+	// MaxRSS is the memory in megabytes the scraper and all processes it started may use before it's killed
+	MaxRSS int `json:"max_rss"`
+	// NoActivityTimeout is the time in seconds the scraper may go without calling the local webserver before it's killed
+	NoActivityTimeout int `json:"no_activity_timeout"`
+}
+
+func (e *EnvWatchdog) validate() error {
+	if e.MaxRuntime < 0 {
+		return errors.New("max_runtime cannot be negative")
+	}
+	if e.MaxRSS < 0 {
+		return errors.New("max_rss cannot be negative")
+	}
+	if e.NoActivityTimeout < 0 {
+		return errors.New("no_activity_timeout cannot be negative")
+	}
+	return nil
+}
+
+func (e *EnvWatchdog) toWatchdogConfig() WatchdogConfig {
+	return WatchdogConfig{
+		MaxRuntime:        time.Duration(e.MaxRuntime) * time.Second,
+		MaxRSS:            int64(e.MaxRSS) * 1024 * 1024,
+		NoActivityTimeout: time.Duration(e.NoActivityTimeout) * time.Second,
+	}
+}
+
+// EnvLogs contains the settings of the scraper output inside the .env file
+type EnvLogs struct {
+	// Format of the scraper output, one of raw (default), text or json
+	Format string `json:"format"`
+	// File is the path of a file to also write the scraper output to, requires the text or json format
+	File string `json:"file"`
+	// MaxSize is the size in megabytes after which the log file is rotated, defaults to 100
+	MaxSize int `json:"max_size"`
+	// MaxAge is the age in days after which rotated log files are removed, 0 means they are never removed because of their age
+	MaxAge int `json:"max_age"`
+	// MaxFiles is the amount of rotated log files that are kept, defaults to 5
+	MaxFiles int `json:"max_files"`
+	// TailLines is the amount of lines kept in memory for /logs, defaults to 1000
+	TailLines int `json:"tail_lines"`
+}
+
+// tagged returns true if the output should be captured and tagged instead of passed through as is
+func (e EnvLogs) tagged() bool {
+	return e.Format == logFormatText || e.Format == logFormatJSON
+}
+
+func (e *EnvLogs) validate() error {
+	switch e.Format {
+	case "", logFormatText, logFormatJSON, logFormatRaw:
+	default:
+		return errors.New("format must be one of: text, json, raw")
+	}
+	if !e.tagged() && e.File != "" {
+		return errors.New("file can only be used with the text or json format")
+	}
+	if e.MaxSize < 0 {
+		return errors.New("max_size cannot be negative")
+	}
+	if e.MaxAge < 0 {
+		return errors.New("max_age cannot be negative")
+	}
+	if e.MaxFiles < 0 {
+		return errors.New("max_files cannot be negative")
+	}
+	if e.TailLines < 0 {
+		return errors.New("tail_lines cannot be negative")
+	}
+	return nil
 }
 
 // EnvUser contains the structure of the login_users inside the .env file
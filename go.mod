@@ -2,11 +2,10 @@ module github.com/script-development/rtcv_scraper_client/v2
 
 go 1.18
 
-require github.com/valyala/fasthttp v1.40.0
-
 require (
-	github.com/gorilla/websocket v1.5.0 // indirect
-	muzzammil.xyz/jsonc v1.0.0 // indirect
+	github.com/gorilla/websocket v1.5.0
+	github.com/valyala/fasthttp v1.40.0
+	muzzammil.xyz/jsonc v1.0.0
 )
 
 require (
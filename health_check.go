@@ -8,9 +8,23 @@ import (
 	"github.com/valyala/fasthttp"
 )
 
-func startHealthCheckServer(port string) {
+// HealthStatus is the response of the /status route of the health check service
+type HealthStatus struct {
+	Websockets []WebsocketState `json:"websockets"`
+	Scrapers   []ScraperStatus  `json:"scrapers"`
+}
+
+func startHealthCheckServer(port string, api *API) {
 	requestHandler := func(ctx *fasthttp.RequestCtx) {
-		ctx.Response.AppendBody([]byte("true"))
+		switch string(ctx.Path()) {
+		case "/status":
+			jsonResp(ctx, HealthStatus{
+				Websockets: api.WebsocketStates(),
+				Scrapers:   api.ScraperStatuses(),
+			})
+		default:
+			ctx.Response.AppendBody([]byte("true"))
+		}
 		ctx.Response.Header.Set("Content-Type", "application/json")
 	}
 
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Job statuses
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+)
+
+// jobRetention is how long finished jobs can still be looked up
+const jobRetention = time.Hour
+
+// ErrJobQueueFull is returned when too many jobs are waiting to be executed
+var ErrJobQueueFull = errors.New("the job queue is full, try again later or send the cv without async")
+
+// ErrJobsStopped is returned when a job is added while the client is shutting down
+var ErrJobsStopped = errors.New("the client is shutting down, no new jobs are accepted")
+
+// Jobs executes cv requests in the background so the scraper does not have to wait on RT-CV
+type Jobs struct {
+	api *API
+
+	lock    sync.Mutex
+	jobs    map[string]*Job
+	queue   chan *jobTask
+	stopped bool
+
+	workers     sync.WaitGroup
+	stopJanitor chan struct{}
+}
+
+// Job is a cv request that is executed in the background
+type Job struct {
+	ID          string    `json:"id"`
+	Namespace   string    `json:"namespace"`
+	ReferenceNr string    `json:"referenceNr"`
+	CreatedAt   time.Time `json:"createdAt"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+	// Status is one of queued, running or done
+	// Note that a done job might still have connections with the queued status if they were added to the outbox
+	Status string `json:"status"`
+	// HasMatches is the hasMatches response of the primary connection, nil if not yet known
+	HasMatches  *bool              `json:"hasMatches"`
+	Connections []ConnectionResult `json:"connections"`
+}
+
+type jobTask struct {
+	job     *Job
+	cv      StrippedCV
+	request cvRequest
+}
+
+// NewJobs creates a new job executor that executes at most workers jobs at the same time
+func NewJobs(api *API, workers int, queueSize int) *Jobs {
+	j := &Jobs{
+		api:         api,
+		jobs:        map[string]*Job{},
+		queue:       make(chan *jobTask, queueSize),
+		stopJanitor: make(chan struct{}),
+	}
+
+	j.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go j.worker()
+	}
+	go j.janitor()
+
+	return j
+}
+
+// Add queues a cv request and returns the id of the created job
+func (j *Jobs) Add(namespace string, cv StrippedCV, req cvRequest) (*Job, error) {
+	id, err := newRandomID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	job := &Job{
+		ID:          id,
+		Namespace:   namespace,
+		ReferenceNr: cv.ReferenceNumber,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		Status:      jobQueued,
+		Connections: []ConnectionResult{},
+	}
+	routed := j.api.route(cv)
+	for idx, conn := range j.api.connections {
+		status := deliveryQueued
+		if !routed[idx] {
+			status = deliverySkipped
+		}
+		job.Connections = append(job.Connections, ConnectionResult{
+			Server:  conn.serverLocation,
+			Primary: idx == j.api.primaryConnection,
+			Status:  status,
+		})
+	}
+
+	// The lock is held while queueing so the queue can't be closed by Stop in the meantime
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if j.stopped {
+		return nil, ErrJobsStopped
+	}
+
+	select {
+	case j.queue <- &jobTask{job: job, cv: cv, request: req}:
+		j.jobs[id] = job
+		return job.copy(), nil
+	default:
+		return nil, ErrJobQueueFull
+	}
+}
+
+// AddDone adds a job that is already done, this is used in mock mode
+func (j *Jobs) AddDone(namespace, referenceNr string, hasMatches bool) (*Job, error) {
+	id, err := newRandomID()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	job := &Job{
+		ID:          id,
+		Namespace:   namespace,
+		ReferenceNr: referenceNr,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		Status:      jobDone,
+		HasMatches:  &hasMatches,
+		Connections: []ConnectionResult{},
+	}
+
+	j.lock.Lock()
+	j.jobs[id] = job
+	j.lock.Unlock()
+
+	return job.copy(), nil
+}
+
+// Get returns a copy of a job
+func (j *Jobs) Get(id string) (*Job, bool) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	job, ok := j.jobs[id]
+	if !ok {
+		return nil, false
+	}
+	return job.copy(), true
+}
+
+func (j *Jobs) worker() {
+	defer j.workers.Done()
+
+	for task := range j.queue {
+		j.lock.Lock()
+		task.job.Status = jobRunning
+		task.job.UpdatedAt = time.Now()
+		j.lock.Unlock()
+
+		result, err := j.api.sendCV(task.job.ID, task.job.Namespace, task.cv, task.request)
+		if err != nil {
+			fmt.Printf("WARN: job %s failed, error: %s\n", task.job.ID, err)
+		}
+
+		j.lock.Lock()
+		for _, connResult := range result.Connections {
+			task.job.setConnectionResult(connResult)
+		}
+		task.job.Status = jobDone
+		task.job.UpdatedAt = time.Now()
+		j.lock.Unlock()
+	}
+}
+
+// setConnectionResult updates the result of a connection of a job, this is used by the outbox to report deliveries of jobs
+func (j *Jobs) setConnectionResult(id string, result ConnectionResult) {
+	if j == nil {
+		return
+	}
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	job, ok := j.jobs[id]
+	if ok {
+		job.setConnectionResult(result)
+	}
+}
+
+// setConnectionResult updates the result of the connection with the same server
+// Expects the lock of Jobs to be held
+func (job *Job) setConnectionResult(result ConnectionResult) {
+	for idx, connResult := range job.Connections {
+		if connResult.Server != result.Server {
+			continue
+		}
+		if result.Status == deliveryQueued && connResult.Status != deliveryQueued {
+			// The outbox might have already delivered the cv before the worker reports it as queued
+			return
+		}
+
+		connResult.Status = result.Status
+		connResult.HasMatches = result.HasMatches
+		connResult.Error = result.Error
+		job.Connections[idx] = connResult
+
+		if connResult.Primary && result.HasMatches != nil {
+			job.HasMatches = result.HasMatches
+		}
+		job.UpdatedAt = time.Now()
+		return
+	}
+}
+
+func (job *Job) copy() *Job {
+	jobCopy := *job
+	jobCopy.Connections = append([]ConnectionResult{}, job.Connections...)
+	return &jobCopy
+}
+
+// Stop stops accepting new jobs and waits until the queued and running jobs are done, after that the workers and janitor exit
+// Returns false if there are still jobs left after the timeout
+func (j *Jobs) Stop(timeout time.Duration) bool {
+	if j == nil {
+		return true
+	}
+
+	j.lock.Lock()
+	if !j.stopped {
+		j.stopped = true
+		close(j.queue)
+		close(j.stopJanitor)
+	}
+	j.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		j.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// janitor removes finished jobs after the jobRetention
+func (j *Jobs) janitor() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-j.stopJanitor:
+			return
+		}
+
+		j.lock.Lock()
+		for id, job := range j.jobs {
+			if job.Status == jobDone && time.Since(job.UpdatedAt) > jobRetention {
+				delete(j.jobs, id)
+			}
+		}
+		j.lock.Unlock()
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestJobs(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"hasMatches":true}`))
+	}))
+	defer primary.Close()
+	alternative := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(400)
+		w.Write([]byte(`{"error":"invalid cv"}`))
+	}))
+	defer alternative.Close()
+
+	api := newTestAPI(t)
+	checkErr(api.SetCredentials([]SetCredentialsArg{
+		{ServerLocation: primary.URL, APIKeyID: "a", APIKey: "b", Primary: true},
+		{ServerLocation: alternative.URL, APIKeyID: "a", APIKey: "b"},
+	}))
+
+	job, err := api.Jobs.Add("", StrippedCV{ReferenceNumber: "ref"}, newScanCVRequest([]byte(`{"referenceNumber":"ref"}`)))
+	checkErr(err)
+	mustEq(jobQueued, job.Status)
+
+	deadline := time.Now().Add(time.Second * 5)
+	for job.Status != jobDone {
+		if time.Now().After(deadline) {
+			t.Fatal("job did not finish in time")
+		}
+		time.Sleep(time.Millisecond * 10)
+		job, _ = api.Jobs.Get(job.ID)
+	}
+
+	if job.HasMatches == nil || !*job.HasMatches {
+		t.Fatal("expected the job to report the matches of the primary server")
+	}
+	mustEq(deliverySent, job.Connections[0].Status)
+	mustEq(deliveryFailed, job.Connections[1].Status)
+	mustEq("invalid cv", job.Connections[1].Error)
+	if !api.CacheEntryExists("", "ref") {
+		t.Fatal("expected the matched cv to be cached")
+	}
+
+	if _, ok := api.Jobs.Get("unknown"); ok {
+		t.Fatal("expected an unknown job to not be found")
+	}
+}
+
+func TestJobsStop(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond * 100)
+		w.Write([]byte(`{"hasMatches":false}`))
+	}))
+	defer primary.Close()
+
+	api := newTestAPI(t)
+	checkErr(api.SetCredentials([]SetCredentialsArg{
+		{ServerLocation: primary.URL, APIKeyID: "a", APIKey: "b", Primary: true},
+	}))
+
+	job, err := api.Jobs.Add("", StrippedCV{ReferenceNumber: "ref"}, newScanCVRequest([]byte(`{"referenceNumber":"ref"}`)))
+	checkErr(err)
+
+	// Stop drains the queued jobs before the workers exit
+	if !api.Jobs.Stop(time.Second * 5) {
+		t.Fatal("expected the queued job to finish before the timeout")
+	}
+	job, _ = api.Jobs.Get(job.ID)
+	mustEq(jobDone, job.Status)
+
+	_, err = api.Jobs.Add("", StrippedCV{ReferenceNumber: "other"}, newScanCVRequest([]byte(`{"referenceNumber":"other"}`)))
+	if err != ErrJobsStopped {
+		t.Fatalf("expected jobs added after stopping to be rejected, got %v", err)
+	}
+	if !api.Jobs.Stop(time.Second) {
+		t.Fatal("expected stopping twice to succeed")
+	}
+}
@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Log formats of the scraper output
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+	// logFormatRaw passes the output of the scraper as is to the stdout and stderr of the client
+	logFormatRaw = "raw"
+)
+
+// Sources of log lines
+const (
+	logStdout = "stdout"
+	logStderr = "stderr"
+	// logClient is the output of the client itself
+	logClient = "client"
+)
+
+// logTimeFormat is the time format of log lines in the text format
+const logTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// logMaxLineLength is the length after which a line is split into multiple log lines
+const logMaxLineLength = 64 * 1024
+
+// defaultLogPruneInterval is how often rotated log files are checked for their max age
+const defaultLogPruneInterval = time.Hour
+
+// LogLine is a line of output of a scraper or the client
+type LogLine struct {
+	Time time.Time `json:"time"`
+	// Scraper is the name of the scraper, empty if the client runs the scraper command passed as arguments or for lines of the client
+	Scraper string `json:"scraper,omitempty"`
+	// Source is stdout, stderr or client
+	Source string `json:"source"`
+	Line   string `json:"line"`
+}
+
+func (l LogLine) text() string {
+	if l.Source == logClient {
+		return l.Time.Format(logTimeFormat) + " [client] " + l.Line + "\n"
+	}
+	scraper := "scraper"
+	if l.Scraper != "" {
+		scraper += " " + l.Scraper
+	}
+	return l.Time.Format(logTimeFormat) + " [" + scraper + "/" + l.Source + "] " + l.Line + "\n"
+}
+
+// Logs captures the output of the scrapers and the client line by line
+// Every line is tagged with the time, scraper and source and written to stdout or stderr, the log file and kept in memory for /logs
+type Logs struct {
+	format string
+	stdout io.Writer
+	stderr io.Writer
+	// pruneInterval is how often the rotated log files are checked for their max age
+	pruneInterval time.Duration
+
+	// clientLock guards client and clientDone
+	clientLock sync.Mutex
+	// client is the write side of the pipe that replaced os.Stdout, see CaptureClient
+	client *os.File
+	// clientDone is closed once all output of the client is read
+	clientDone chan struct{}
+	// stopPrune stops removing old rotated log files on an interval
+	stopPrune chan struct{}
+
+	lock sync.Mutex
+	file *rotatingLogFile
+	// tail is a ring buffer of the last lines, next is the index the next line is written to
+	tail []LogLine
+	next int
+	full bool
+}
+
+// NewLogs creates a log capturer that writes lines in format to stdout, or stderr for stderr lines of the scrapers,
+// and keeps the last tailLines lines in memory
+func NewLogs(format string, stdout, stderr io.Writer, tailLines int) *Logs {
+	if format == "" {
+		format = logFormatText
+	}
+	if tailLines <= 0 {
+		tailLines = 1000
+	}
+
+	return &Logs{
+		format:        format,
+		stdout:        stdout,
+		stderr:        stderr,
+		pruneInterval: defaultLogPruneInterval,
+		tail:          make([]LogLine, tailLines),
+	}
+}
+
+// UseFile makes the logs also write all lines to a file that is rotated once it grows larger than maxSize bytes
+// Rotated files older than maxAge are removed and at most maxFiles rotated files are kept, 0 disables these limits
+func (l *Logs) UseFile(path string, maxSize int64, maxAge time.Duration, maxFiles int) error {
+	file, err := openRotatingLogFile(path, maxSize, maxAge, maxFiles)
+	if err != nil {
+		return err
+	}
+
+	l.lock.Lock()
+	l.file = file
+	l.lock.Unlock()
+
+	if maxAge > 0 {
+		// Without this rotated files would only be removed on the next rotation, which might never happen for a quiet scraper
+		l.stopPrune = make(chan struct{})
+		go l.pruneOldFiles(file, l.stopPrune)
+	}
+	return nil
+}
+
+// pruneOldFiles removes the rotated files of file that are too old every prune interval until stop is closed
+func (l *Logs) pruneOldFiles(file *rotatingLogFile, stop chan struct{}) {
+	ticker := time.NewTicker(l.pruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			l.lock.Lock()
+			file.removeOld()
+			l.lock.Unlock()
+		}
+	}
+}
+
+// CaptureClient replaces os.Stdout so the output of the client itself is also written to the logs, tagged with the client source
+// Without this the untagged lines of the client would be mixed with the tagged lines of the scrapers
+//
+// The output of the log package is also tagged, see clientErrorWriter
+func (l *Logs) CaptureClient() error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	l.clientLock.Lock()
+	l.client = w
+	l.clientDone = make(chan struct{})
+	l.clientLock.Unlock()
+
+	os.Stdout = w
+	// The lines are already tagged with the time
+	log.SetFlags(0)
+	log.SetOutput(clientErrorWriter{l})
+	go func() {
+		l.readLines(r, "", logClient)
+		close(l.clientDone)
+	}()
+	return nil
+}
+
+// flushClient stops capturing the output of the client and waits until all captured lines are written
+// Returns false if the output of the client was not captured
+func (l *Logs) flushClient() bool {
+	l.clientLock.Lock()
+	defer l.clientLock.Unlock()
+
+	if l.client == nil {
+		return false
+	}
+
+	if stdout, ok := l.stdout.(*os.File); ok {
+		os.Stdout = stdout
+	}
+	l.client.Close()
+	<-l.clientDone
+	l.client = nil
+	return true
+}
+
+// clientErrorWriter is the output of the log package while the output of the client is captured
+// The client only uses log.Fatal, which exits right after writing, so the captured lines of the client are written first as they would be lost otherwise
+type clientErrorWriter struct {
+	logs *Logs
+}
+
+func (w clientErrorWriter) Write(b []byte) (int, error) {
+	w.logs.flushClient()
+	w.logs.add(LogLine{
+		Time:   time.Now(),
+		Source: logClient,
+		Line:   strings.TrimRight(string(b), "\n"),
+	}, true)
+	return len(b), nil
+}
+
+// capture makes the output of cmd be written to the logs
+// Returns a function that should be called after the command is started, it closes the client side of the pipes
+//
+// We create the pipes ourselves instead of setting an io.Writer as cmd.Stdout, otherwise cmd.Wait would
+// wait for processes started by the scraper that keep the pipes open after the scraper exited
+func (l *Logs) capture(cmd *exec.Cmd, scraper string) (func(), error) {
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stderrR, stderrW, err := os.Pipe()
+	if err != nil {
+		stdoutR.Close()
+		stdoutW.Close()
+		return nil, err
+	}
+
+	cmd.Stdout = stdoutW
+	cmd.Stderr = stderrW
+	go l.readLines(stdoutR, scraper, logStdout)
+	go l.readLines(stderrR, scraper, logStderr)
+
+	return func() {
+		stdoutW.Close()
+		stderrW.Close()
+	}, nil
+}
+
+func (l *Logs) readLines(r *os.File, scraper, source string) {
+	defer r.Close()
+
+	reader := bufio.NewReaderSize(r, logMaxLineLength)
+	// carry is the start of a character that was cut off at the end of the previous part of a too long line
+	var carry []byte
+	for {
+		line, err := reader.ReadSlice('\n')
+		if len(carry) > 0 {
+			line = append(carry, line...)
+			carry = nil
+		}
+		if err == bufio.ErrBufferFull {
+			// Split the too long line between characters so every part is valid utf8
+			cut := completeRunesLen(line)
+			carry = append([]byte{}, line[cut:]...)
+			line = line[:cut]
+		}
+		if len(line) > 0 {
+			l.Add(LogLine{
+				Time:    time.Now(),
+				Scraper: scraper,
+				Source:  source,
+				Line:    strings.TrimRight(string(line), "\r\n"),
+			})
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return
+		}
+	}
+}
+
+// completeRunesLen returns the length of b without a multi-byte character that is cut off at the end
+func completeRunesLen(b []byte) int {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if !utf8.RuneStart(b[i]) {
+			continue
+		}
+		if utf8.FullRune(b[i:]) {
+			return len(b)
+		}
+		return i
+	}
+	return len(b)
+}
+
+// Add writes a line to stdout or stderr and the log file and keeps it for /logs
+func (l *Logs) Add(line LogLine) {
+	l.add(line, line.Source == logStderr)
+}
+
+func (l *Logs) add(line LogLine, toStderr bool) {
+	var formatted []byte
+	if l.format == logFormatJSON {
+		formatted, _ = json.Marshal(line)
+		formatted = append(formatted, '\n')
+	} else {
+		formatted = []byte(line.text())
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.tail[l.next] = line
+	l.next = (l.next + 1) % len(l.tail)
+	if l.next == 0 {
+		l.full = true
+	}
+
+	if toStderr {
+		l.stderr.Write(formatted)
+	} else {
+		l.stdout.Write(formatted)
+	}
+	if l.file != nil {
+		l.file.Write(formatted)
+	}
+}
+
+// LogFilter selects the lines returned by Tail
+type LogFilter struct {
+	// Scraper only returns lines of this scraper if set
+	Scraper *string
+	// Source only returns stdout, stderr or client lines if set
+	Source string
+}
+
+// Tail returns the last n lines matching filter, oldest first
+func (l *Logs) Tail(n int, filter LogFilter) []LogLine {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	lines := []LogLine{}
+	count := l.next
+	if l.full {
+		count = len(l.tail)
+	}
+	// Walk from the newest to the oldest line
+	for i := 1; i <= count && len(lines) < n; i++ {
+		line := l.tail[(l.next-i+len(l.tail))%len(l.tail)]
+		if filter.Scraper != nil && line.Scraper != *filter.Scraper {
+			continue
+		}
+		if filter.Source != "" && line.Source != filter.Source {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	for i, j := 0, len(lines)-1; i < j; i, j = i+1, j-1 {
+		lines[i], lines[j] = lines[j], lines[i]
+	}
+	return lines
+}
+
+// rotatingLogFile is a log file that is renamed to path.{timestamp} once it grows larger than maxSize
+type rotatingLogFile struct {
+	path     string
+	maxSize  int64
+	maxAge   time.Duration
+	maxFiles int
+
+	f    *os.File
+	size int64
+	// failed is set after a write error so the warning is only printed once
+	failed bool
+}
+
+func openRotatingLogFile(path string, maxSize int64, maxAge time.Duration, maxFiles int) (*rotatingLogFile, error) {
+	file := &rotatingLogFile{
+		path:     path,
+		maxSize:  maxSize,
+		maxAge:   maxAge,
+		maxFiles: maxFiles,
+	}
+	err := file.open()
+	if err != nil {
+		return nil, err
+	}
+	file.removeOld()
+	return file, nil
+}
+
+func (f *rotatingLogFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("unable to open log file, error: %s", err.Error())
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("unable to open log file, error: %s", err.Error())
+	}
+
+	f.f = file
+	f.size = stat.Size()
+	return nil
+}
+
+func (f *rotatingLogFile) Write(b []byte) {
+	err := f.write(b)
+	if err != nil && !f.failed {
+		fmt.Printf("WARN: unable to write to log file %s, error: %s\n", f.path, err)
+	}
+	f.failed = err != nil
+}
+
+func (f *rotatingLogFile) write(b []byte) error {
+	if f.f == nil {
+		err := f.open()
+		if err != nil {
+			return err
+		}
+	}
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(b)) > f.maxSize {
+		err := f.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := f.f.Write(b)
+	f.size += int64(n)
+	return err
+}
+
+func (f *rotatingLogFile) rotate() error {
+	f.f.Close()
+	f.f = nil
+
+	err := os.Rename(f.path, f.path+"."+time.Now().Format("20060102-150405.000"))
+	if err != nil {
+		return fmt.Errorf("unable to rotate log file, error: %s", err.Error())
+	}
+	f.removeOld()
+	return f.open()
+}
+
+// removeOld removes the rotated files that are older than maxAge or exceed maxFiles
+func (f *rotatingLogFile) removeOld() {
+	rotated, err := filepath.Glob(f.path + ".[0-9]*")
+	if err != nil {
+		return
+	}
+	// The timestamp suffix makes sorting by name equal to sorting by age, newest first
+	sort.Sort(sort.Reverse(sort.StringSlice(rotated)))
+
+	for idx, path := range rotated {
+		remove := f.maxFiles > 0 && idx >= f.maxFiles
+		if !remove && f.maxAge > 0 {
+			stat, err := os.Stat(path)
+			remove = err == nil && time.Since(stat.ModTime()) > f.maxAge
+		}
+		if remove {
+			os.Remove(path)
+		}
+	}
+}
+
+// Close stops capturing the output of the client and closes the log file
+func (l *Logs) Close() error {
+	// Restore the original stdout and wait for the last lines of the client to be written
+	if l.flushClient() {
+		log.SetFlags(log.LstdFlags)
+		log.SetOutput(os.Stderr)
+	}
+	if l.stopPrune != nil {
+		close(l.stopPrune)
+		l.stopPrune = nil
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	file := l.file
+	l.file = nil
+	if file == nil || file.f == nil {
+		return nil
+	}
+	return file.f.Close()
+}
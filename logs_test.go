@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestLogsCaptureScraperOutput(t *testing.T) {
+	out := &bytes.Buffer{}
+	errOut := &bytes.Buffer{}
+	logs := NewLogs(logFormatText, out, errOut, 100)
+
+	p := NewScraperProcess("site-a", []string{"sh", "-c", "echo out; echo err >&2; printf partial"}, os.Environ())
+	p.SetLogs(logs)
+	checkErr(p.Run())
+
+	// The output is read in the background
+	for i := 0; len(logs.Tail(10, LogFilter{})) < 3 && i < 500; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stderr := logs.Tail(10, LogFilter{Source: logStderr})
+	if len(stderr) != 1 {
+		t.Fatalf("expected 1 stderr line but got %+v", stderr)
+	}
+	mustEq("err", stderr[0].Line)
+	mustEq("site-a", stderr[0].Scraper)
+
+	stdout := logs.Tail(10, LogFilter{Source: logStdout})
+	if len(stdout) != 2 {
+		t.Fatalf("expected 2 stdout lines but got %+v", stdout)
+	}
+	mustEq("out", stdout[0].Line)
+	mustEq("partial", stdout[1].Line)
+
+	otherScraper := "site-b"
+	if len(logs.Tail(10, LogFilter{Scraper: &otherScraper})) != 0 {
+		t.Fatal("expected no lines of another scraper")
+	}
+
+	logs.lock.Lock()
+	written := out.String()
+	writtenErr := errOut.String()
+	logs.lock.Unlock()
+	if !strings.Contains(writtenErr, " [scraper site-a/stderr] err\n") {
+		t.Fatalf("expected the stderr output to be tagged and written to stderr but got %q", writtenErr)
+	}
+	if strings.Contains(written, "stderr") || !strings.Contains(written, " [scraper site-a/stdout] out\n") {
+		t.Fatalf("expected only the stdout output to be written to stdout but got %q", written)
+	}
+}
+
+func TestLogsCaptureClient(t *testing.T) {
+	out, err := os.CreateTemp(t.TempDir(), "stdout")
+	checkErr(err)
+	defer out.Close()
+
+	originalStdout := os.Stdout
+	defer func() {
+		os.Stdout = originalStdout
+	}()
+	os.Stdout = out
+
+	errOut := &bytes.Buffer{}
+	logs := NewLogs(logFormatJSON, out, errOut, 10)
+	checkErr(logs.CaptureClient())
+	fmt.Println("connected to RTCV")
+
+	// log.Fatal exits right after writing so the lines printed before it must already be written
+	log.Print("unable to start")
+	if os.Stdout != out {
+		t.Fatal("expected stdout to be restored before the fatal error is written")
+	}
+
+	checkErr(logs.Close())
+	if os.Stdout != out {
+		t.Fatal("expected stdout to be restored after closing the logs")
+	}
+
+	lines := logs.Tail(10, LogFilter{Source: logClient})
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 client lines but got %+v", lines)
+	}
+	mustEq("connected to RTCV", lines[0].Line)
+	mustEq("unable to start", lines[1].Line)
+	if !strings.Contains(errOut.String(), `"source":"client","line":"unable to start"`) {
+		t.Fatalf("expected the fatal error to be tagged and written to stderr but got %q", errOut.String())
+	}
+
+	written, err := os.ReadFile(out.Name())
+	checkErr(err)
+	if !strings.Contains(string(written), `"source":"client","line":"connected to RTCV"`) {
+		t.Fatalf("expected the output of the client to be tagged but got %q", written)
+	}
+	mustEq(" [client] connected to RTCV\n", strings.TrimPrefix(lines[0].text(), lines[0].Time.Format(logTimeFormat)))
+}
+
+func TestLogsTail(t *testing.T) {
+	logs := NewLogs(logFormatJSON, &bytes.Buffer{}, &bytes.Buffer{}, 3)
+	for i := 0; i < 5; i++ {
+		logs.Add(LogLine{Source: logStdout, Line: strconv.Itoa(i)})
+	}
+
+	lines := logs.Tail(10, LogFilter{})
+	if len(lines) != 3 {
+		t.Fatalf("expected only the last 3 lines to be kept but got %+v", lines)
+	}
+	mustEq("2", lines[0].Line)
+	mustEq("4", lines[2].Line)
+
+	lines = logs.Tail(1, LogFilter{})
+	if len(lines) != 1 {
+		t.Fatalf("expected 1 line but got %+v", lines)
+	}
+	mustEq("4", lines[0].Line)
+}
+
+func TestRotatingLogFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scraper.log")
+	logs := NewLogs(logFormatText, &bytes.Buffer{}, &bytes.Buffer{}, 10)
+	checkErr(logs.UseFile(path, 200, 0, 2))
+
+	for i := 0; i < 10; i++ {
+		logs.Add(LogLine{Time: time.Now(), Source: logStdout, Line: strings.Repeat("a", 50)})
+		// Rotated files are named after the time they are rotated
+		time.Sleep(2 * time.Millisecond)
+	}
+	checkErr(logs.Close())
+
+	stat, err := os.Stat(path)
+	checkErr(err)
+	if stat.Size() > 200 {
+		t.Fatalf("expected the log file to be rotated before exceeding the max size but it's %d bytes", stat.Size())
+	}
+	rotated, err := filepath.Glob(path + ".*")
+	checkErr(err)
+	if len(rotated) != 2 {
+		t.Fatalf("expected 2 rotated files to be kept but got %v", rotated)
+	}
+}
+
+func TestRotatingLogFileMaxAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scraper.log")
+	old := path + ".20220912-100000.000"
+	checkErr(os.WriteFile(old, []byte("old\n"), 0o644))
+	logs := NewLogs(logFormatText, &bytes.Buffer{}, &bytes.Buffer{}, 10)
+	logs.pruneInterval = 10 * time.Millisecond
+	checkErr(logs.UseFile(path, 0, time.Hour, 0))
+	defer logs.Close()
+
+	// The file becomes too old while the client runs without the log file being rotated
+	_, err := os.Stat(old)
+	checkErr(err)
+	longAgo := time.Now().Add(-2 * time.Hour)
+	checkErr(os.Chtimes(old, longAgo, longAgo))
+	for i := 0; i < 500; i++ {
+		_, err = os.Stat(old)
+		if os.IsNotExist(err) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("expected the too old rotated file to be removed without a rotation")
+}
+
+func TestLogsCloseWithoutOpenFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scraper.log")
+	logs := NewLogs(logFormatText, &bytes.Buffer{}, &bytes.Buffer{}, 10)
+	checkErr(logs.UseFile(path, 0, 0, 0))
+
+	// Like after a rotation where the new file could not be opened
+	logs.file.f.Close()
+	logs.file.f = nil
+	checkErr(logs.Close())
+	checkErr(os.Remove(path))
+
+	logs.Add(LogLine{Time: time.Now(), Source: logStdout, Line: "after close"})
+	_, err := os.Stat(path)
+	if !os.IsNotExist(err) {
+		t.Fatal("expected the log file to not be re-opened after closing the logs")
+	}
+}
+
+func TestLogsSplitLongLines(t *testing.T) {
+	logs := NewLogs(logFormatText, &bytes.Buffer{}, &bytes.Buffer{}, 10)
+
+	r, w, err := os.Pipe()
+	checkErr(err)
+	done := make(chan struct{})
+	go func() {
+		logs.readLines(r, "", logStdout)
+		close(done)
+	}()
+
+	// The multi-byte character falls on the line length limit
+	long := strings.Repeat("a", logMaxLineLength-1) + "é"
+	_, err = w.WriteString(long + "\nshort\n")
+	checkErr(err)
+	w.Close()
+	<-done
+
+	lines := logs.Tail(10, LogFilter{})
+	if len(lines) != 3 {
+		t.Fatalf("expected the long line to be split in 2 lines but got %d lines", len(lines))
+	}
+	for _, line := range lines {
+		if !utf8.ValidString(line.Line) {
+			t.Fatal("expected the long line to be split between characters")
+		}
+	}
+	mustEq(long, lines[0].Line+lines[1].Line)
+	mustEq("é", lines[1].Line)
+	mustEq("short", lines[2].Line)
+}
@@ -4,9 +4,8 @@ import (
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"sync"
-	"syscall"
+	"time"
 
 	"github.com/script-development/rtcv_scraper_client/v2/crypto"
 )
@@ -16,18 +15,45 @@ func main() {
 
 	api := NewAPI()
 
+	var err error
+	if env.Logs.tagged() {
+		api.Logs = NewLogs(env.Logs.Format, os.Stdout, os.Stderr, env.Logs.TailLines)
+		if env.Logs.File != "" {
+			maxSize := env.Logs.MaxSize
+			if maxSize == 0 {
+				maxSize = 100
+			}
+			maxFiles := env.Logs.MaxFiles
+			if maxFiles == 0 {
+				maxFiles = 5
+			}
+			maxAge := time.Duration(env.Logs.MaxAge) * 24 * time.Hour
+			err = api.Logs.UseFile(env.Logs.File, int64(maxSize)*1024*1024, maxAge, maxFiles)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		err = api.Logs.CaptureClient()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	credentials := []SetCredentialsArg{env.PrimaryServer.toCredArg(true)}
 	for _, server := range env.AlternativeServers {
 		credentials = append(credentials, server.toCredArg(false))
 	}
 
-	var err error
 	var loginUsers []EnvUser
 	if !env.MockMode {
 		err = api.SetCredentials(credentials)
 		if err != nil {
 			log.Fatal(err)
 		}
+		err = api.SetRoutingRules(env.RoutingRules)
+		if err != nil {
+			log.Fatal(err)
+		}
 		decryptionKey := crypto.LoadAndVerivyKeys(env.PublicKey, env.PrivateKey)
 
 		fmt.Println("credentials set")
@@ -41,37 +67,77 @@ func main() {
 		fmt.Println("You can turn this off in `env.json` by setting `mock_mode` to false")
 	}
 
-	api.ConnectToAllWebsockets()
-	useAddress := startWebserver(env, api, loginUsers)
-
-	healthCheckPort := os.Getenv("RTCV_SCRAPER_CLIENT_HEALTH_CHECK_PORT")
-	if healthCheckPort != "" {
-		go startHealthCheckServer(healthCheckPort)
+	api.Cache.Configure(env.CacheMaxEntries, env.CacheNamespaces)
+	if env.CacheFile != "" {
+		err = api.Cache.UseFile(env.CacheFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("loaded", api.Cache.Len(), "cached references from", env.CacheFile)
+	}
+	if env.SharedCache != nil {
+		api.SharedCache = newRedisCache(*env.SharedCache)
 	}
 
-	fmt.Println("running scraper..")
+	if env.OutboxDir != "" && !env.MockMode {
+		api.Outbox, err = NewOutbox(api, env.OutboxDir, env.OutboxMaxAttempts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		api.Outbox.Start()
+	}
 
-	if len(os.Args) <= 1 {
-		log.Fatal("must provide a command to run, for example: rtcv_scraper_client npm run scraper")
+	wsResponseTimeouts := map[string]time.Duration{}
+	for msgType, timeout := range env.WSResponseTimeouts {
+		wsResponseTimeouts[msgType] = time.Duration(timeout) * time.Second
 	}
+	api.wsPending.SetTimeouts(time.Duration(env.WSResponseTimeout)*time.Second, wsResponseTimeouts)
+	api.wsConfig.responseMaxAge = time.Duration(env.WSResponseMaxAge) * time.Second
 
-	scraper := exec.Command(os.Args[1], os.Args[2:]...)
-	scraper.Env = append(os.Environ(), "SCRAPER_ADDRESS="+useAddress)
+	// The webserver only starts serving once the scrapers are created as its request handler reads them
+	useAddress, listener := listenWebserver()
 
-	// Piple output of scraper to stdout
-	scraper.Stdin = os.Stdin
-	scraper.Stdout = os.Stdout
-	scraper.Stderr = os.Stderr
+	gracePeriod := defaultShutdownGracePeriod
+	if env.ShutdownGracePeriod > 0 {
+		gracePeriod = time.Duration(env.ShutdownGracePeriod) * time.Second
+	}
 
-	err = scraper.Run()
-	if err != nil {
-		if exiterr, ok := err.(*exec.ExitError); ok {
-			if status, ok := exiterr.Sys().(syscall.WaitStatus); ok {
-				os.Exit(status.ExitStatus())
-			}
+	scraperConfigs := env.Scrapers
+	if len(scraperConfigs) == 0 {
+		if len(os.Args) <= 1 {
+			log.Fatal("must provide a command to run, for example: rtcv_scraper_client npm run scraper")
+		}
+		scraperConfigs = []EnvScraper{{Command: os.Args[1:]}}
+	} else if len(os.Args) > 1 {
+		log.Fatal("the scrapers to run are configured in the env file, the command arguments cannot be used in combination with scrapers")
+	}
+	for _, config := range scraperConfigs {
+		scraper, err := api.newScraper(env, config, useAddress, loginUsers, gracePeriod)
+		if err != nil {
+			log.Fatal(err)
 		}
+		api.Scrapers = append(api.Scrapers, scraper)
+	}
+	server := serveWebserver(env, api, loginUsers, listener)
+
+	api.ConnectToAllWebsockets()
+
+	healthCheckPort := os.Getenv("RTCV_SCRAPER_CLIENT_HEALTH_CHECK_PORT")
+	if healthCheckPort != "" {
+		go startHealthCheckServer(healthCheckPort, api)
+	}
+
+	forwardShutdownSignals(api, gracePeriod)
+
+	err = api.RunScrapers()
+	code, exited := exitCode(err)
+	if !exited {
 		log.Fatal(err)
 	}
+
+	fmt.Println("shutting down..")
+	shutdown(api, server, gracePeriod)
+	os.Exit(code)
 }
 
 func testServerConnections(api *API, apiKeyID string, decryptionKey *crypto.Key) []EnvUser {
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Outbox contains cv requests that could not be delivered to one or more RT-CV servers
+// A background worker re-sends the requests with an exponential backoff until they are delivered or the max attempts are reached
+//
+// Every item is stored as a json file inside the outbox directory so no scraped data is lost when the scraper client restarts
+type Outbox struct {
+	api         *API
+	dir         string
+	maxAttempts int
+
+	lock  sync.Mutex
+	items map[string]*OutboxItem
+	wake  chan struct{}
+}
+
+// OutboxItem is a cv request inside the outbox
+type OutboxItem struct {
+	ID          string          `json:"id"`
+	Namespace   string          `json:"namespace"`
+	ReferenceNr string          `json:"referenceNr"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	Request     cvRequest       `json:"request"`
+	Targets     []*OutboxTarget `json:"targets"`
+
+	// inFlight is true while the worker is delivering this item
+	inFlight bool
+}
+
+// OutboxTarget is a server an outbox item still needs to be delivered to
+type OutboxTarget struct {
+	ServerLocation string    `json:"serverLocation"`
+	Attempts       int       `json:"attempts"`
+	NextAttempt    time.Time `json:"nextAttempt"`
+	LastError      string    `json:"lastError,omitempty"`
+	// Failed is set when the max attempts are reached, failed targets are only retried after a re-drive
+	Failed bool `json:"failed"`
+}
+
+const (
+	outboxMinBackoff = time.Second * 5
+	outboxMaxBackoff = time.Minute * 30
+)
+
+// NewOutbox creates a new outbox that stores it's items inside dir
+func NewOutbox(api *API, dir string, maxAttempts int) (*Outbox, error) {
+	if maxAttempts <= 0 {
+		maxAttempts = 10
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create outbox directory, error: %s", err.Error())
+	}
+
+	o := &Outbox{
+		api:         api,
+		dir:         dir,
+		maxAttempts: maxAttempts,
+		items:       map[string]*OutboxItem{},
+		wake:        make(chan struct{}, 1),
+	}
+
+	err = o.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+// load reads all the items inside the outbox directory
+func (o *Outbox) load() error {
+	files, err := os.ReadDir(o.dir)
+	if err != nil {
+		return fmt.Errorf("unable to read outbox directory, error: %s", err.Error())
+	}
+
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+
+		path := filepath.Join(o.dir, file.Name())
+		itemBytes, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("unable to read outbox item %s, error: %s", file.Name(), err.Error())
+		}
+
+		item := &OutboxItem{}
+		err = json.Unmarshal(itemBytes, item)
+		if err != nil || item.ID == "" {
+			// Items are written to a temp file and then renamed so this should never happen
+			fmt.Printf("WARN: ignoring invalid outbox item %s\n", path)
+			continue
+		}
+
+		o.items[item.ID] = item
+	}
+
+	return nil
+}
+
+// Start starts the worker that delivers the outbox items
+func (o *Outbox) Start() {
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		for {
+			o.deliverDue()
+
+			select {
+			case <-ticker.C:
+			case <-o.wake:
+			}
+		}
+	}()
+}
+
+// Add adds a cv request to the outbox for the connections with the provided indexes
+// If id is empty a random id is generated
+func (o *Outbox) Add(id, namespace, referenceNr string, req cvRequest, connectionIdxs []int) (*OutboxItem, error) {
+	var err error
+	if id == "" {
+		id, err = newRandomID()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	item := &OutboxItem{
+		ID:          id,
+		Namespace:   namespace,
+		ReferenceNr: referenceNr,
+		CreatedAt:   now,
+		Request:     req,
+	}
+	for _, idx := range connectionIdxs {
+		item.Targets = append(item.Targets, &OutboxTarget{
+			ServerLocation: o.api.connections[idx].serverLocation,
+			NextAttempt:    now,
+		})
+	}
+
+	o.lock.Lock()
+	err = o.save(item)
+	if err == nil {
+		o.items[id] = item
+	}
+	o.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	o.notify()
+	return item, nil
+}
+
+func (o *Outbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliverDue starts delivering all the items that have targets ready to be retried
+func (o *Outbox) deliverDue() {
+	now := time.Now()
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	for _, item := range o.items {
+		if item.inFlight {
+			continue
+		}
+		for _, target := range item.Targets {
+			if !target.Failed && !now.Before(target.NextAttempt) {
+				item.inFlight = true
+				go o.deliver(item)
+				break
+			}
+		}
+	}
+}
+
+// deliver tries to deliver an item to all it's due targets
+func (o *Outbox) deliver(item *OutboxItem) {
+	o.lock.Lock()
+	now := time.Now()
+	due := []OutboxTarget{}
+	for _, target := range item.Targets {
+		if !target.Failed && !now.Before(target.NextAttempt) {
+			due = append(due, *target)
+		}
+	}
+	o.lock.Unlock()
+
+	results := map[string]error{}
+	for _, target := range due {
+		conn, idx, ok := o.api.connectionByLocation(target.ServerLocation)
+		if !ok {
+			results[target.ServerLocation] = errors.New("server is no longer configured")
+			continue
+		}
+
+		var response scanCVResponse
+		err := item.Request.send(conn, &response)
+		results[target.ServerLocation] = err
+		if err == nil && idx == o.api.primaryConnection && response.HasMatches && item.ReferenceNr != "" {
+			o.api.SetCacheEntry(item.Namespace, item.ReferenceNr, o.api.Cache.Namespace(item.Namespace).TTL)
+		}
+		if err == nil {
+			o.api.Jobs.setConnectionResult(item.ID, ConnectionResult{
+				Server:     target.ServerLocation,
+				Primary:    idx == o.api.primaryConnection,
+				Status:     deliverySent,
+				HasMatches: &response.HasMatches,
+			})
+		}
+	}
+
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	item.inFlight = false
+	remainingTargets := []*OutboxTarget{}
+	for _, target := range item.Targets {
+		err, attempted := results[target.ServerLocation]
+		if !attempted {
+			remainingTargets = append(remainingTargets, target)
+			continue
+		}
+		if err == nil {
+			fmt.Printf("delivered outbox item %s to %s\n", item.ID, target.ServerLocation)
+			continue
+		}
+
+		target.Attempts++
+		target.LastError = err.Error()
+		if target.Attempts >= o.maxAttempts {
+			target.Failed = true
+			fmt.Printf("WARN: giving up on delivering outbox item %s to %s after %d attempts, error: %s\n", item.ID, target.ServerLocation, target.Attempts, err)
+			o.api.Jobs.setConnectionResult(item.ID, ConnectionResult{
+				Server: target.ServerLocation,
+				Status: deliveryFailed,
+				Error:  err.Error(),
+			})
+		} else {
+			target.NextAttempt = time.Now().Add(outboxBackoff(target.Attempts))
+		}
+		remainingTargets = append(remainingTargets, target)
+	}
+	item.Targets = remainingTargets
+
+	if len(item.Targets) == 0 {
+		delete(o.items, item.ID)
+		err := os.Remove(o.itemPath(item.ID))
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Printf("WARN: unable to remove delivered outbox item %s, error: %s\n", item.ID, err)
+		}
+		return
+	}
+
+	err := o.save(item)
+	if err != nil {
+		fmt.Printf("WARN: unable to save outbox item %s, error: %s\n", item.ID, err)
+	}
+}
+
+// outboxBackoff returns the time to wait before the next attempt
+func outboxBackoff(attempts int) time.Duration {
+	backoff := outboxMinBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= outboxMaxBackoff {
+			return outboxMaxBackoff
+		}
+	}
+	return backoff
+}
+
+// OutboxStatus contains the state of the outbox
+type OutboxStatus struct {
+	// Depth is the amount of items in the outbox
+	Depth int `json:"depth"`
+	// Failed is the amount of items with at least one target that reached the max attempts
+	Failed int                `json:"failed"`
+	Items  []OutboxItemStatus `json:"items"`
+}
+
+// OutboxItemStatus is an outbox item without the request body
+type OutboxItemStatus struct {
+	ID          string         `json:"id"`
+	Namespace   string         `json:"namespace"`
+	ReferenceNr string         `json:"referenceNr"`
+	CreatedAt   time.Time      `json:"createdAt"`
+	Targets     []OutboxTarget `json:"targets"`
+}
+
+// Status returns the state of the outbox, if onlyFailed is true only the items with failed targets are returned
+func (o *Outbox) Status(onlyFailed bool) OutboxStatus {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	status := OutboxStatus{
+		Depth: len(o.items),
+		Items: []OutboxItemStatus{},
+	}
+	for _, item := range o.items {
+		itemStatus := OutboxItemStatus{
+			ID:          item.ID,
+			Namespace:   item.Namespace,
+			ReferenceNr: item.ReferenceNr,
+			CreatedAt:   item.CreatedAt,
+		}
+		failed := false
+		for _, target := range item.Targets {
+			itemStatus.Targets = append(itemStatus.Targets, *target)
+			failed = failed || target.Failed
+		}
+		if failed {
+			status.Failed++
+		}
+		if failed || !onlyFailed {
+			status.Items = append(status.Items, itemStatus)
+		}
+	}
+
+	sort.Slice(status.Items, func(i, j int) bool {
+		return status.Items[i].CreatedAt.Before(status.Items[j].CreatedAt)
+	})
+	return status
+}
+
+// Redrive resets the attempts of the failed targets so they are retried
+// If id is empty all failed items are re-driven, returns the amount of re-driven items
+func (o *Outbox) Redrive(id string) (int, error) {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	items := []*OutboxItem{}
+	if id != "" {
+		item, ok := o.items[id]
+		if !ok {
+			return 0, fmt.Errorf("outbox item %s not found", id)
+		}
+		items = append(items, item)
+	} else {
+		for _, item := range o.items {
+			items = append(items, item)
+		}
+	}
+
+	redriven := 0
+	now := time.Now()
+	for _, item := range items {
+		itemRedriven := false
+		for _, target := range item.Targets {
+			if target.Failed || id != "" {
+				target.Failed = false
+				target.Attempts = 0
+				target.NextAttempt = now
+				itemRedriven = true
+			}
+		}
+		if !itemRedriven {
+			continue
+		}
+		redriven++
+
+		err := o.save(item)
+		if err != nil {
+			return redriven, err
+		}
+	}
+
+	o.notify()
+	return redriven, nil
+}
+
+func (o *Outbox) itemPath(id string) string {
+	return filepath.Join(o.dir, id+".json")
+}
+
+// save writes an item to disk
+// The item is written to a temp file first and then renamed so a crash never leaves a half written item behind
+// Expects the lock to be held
+func (o *Outbox) save(item *OutboxItem) error {
+	itemBytes, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+
+	path := o.itemPath(item.ID)
+	tmpPath := path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(itemBytes)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return err
+	}
+	syncDir(o.dir)
+	return nil
+}
+
+// newRandomID returns a random hex encoded id
+func newRandomID() (string, error) {
+	id := make([]byte, 16)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
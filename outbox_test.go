@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestOutbox(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(500)
+			w.Write([]byte(`{"error":"temporarily unavailable"}`))
+			return
+		}
+		w.Write([]byte(`{"hasMatches":true}`))
+	}))
+	defer server.Close()
+
+	api := newTestAPI(t)
+	checkErr(api.SetCredentials([]SetCredentialsArg{{ServerLocation: server.URL, APIKeyID: "a", APIKey: "b", Primary: true}}))
+
+	dir := t.TempDir()
+	outbox, err := NewOutbox(api, dir, 2)
+	checkErr(err)
+
+	item, err := outbox.Add("", "", "ref", newScanCVRequest([]byte(`{"referenceNumber":"ref"}`)), []int{0})
+	checkErr(err)
+
+	outbox.deliver(item)
+	status := outbox.Status(false)
+	if status.Depth != 1 || status.Items[0].Targets[0].Attempts != 1 || status.Items[0].Targets[0].LastError != "temporarily unavailable" {
+		t.Fatalf("expected the failed delivery to be recorded, got %+v", status)
+	}
+
+	// A restarted scraper client should pick up the item from disk
+	reloaded, err := NewOutbox(api, dir, 2)
+	checkErr(err)
+	if reloaded.Status(false).Depth != 1 {
+		t.Fatal("expected the outbox item to be loaded from disk")
+	}
+
+	_, err = reloaded.Redrive(item.ID)
+	checkErr(err)
+	reloaded.deliver(reloaded.items[item.ID])
+	if reloaded.Status(false).Depth != 0 {
+		t.Fatal("expected the item to be removed from the outbox after it was delivered")
+	}
+	if _, err := os.Stat(reloaded.itemPath(item.ID)); !os.IsNotExist(err) {
+		t.Fatal("expected the delivered item to be removed from disk")
+	}
+	if !api.CacheEntryExists("", "ref") {
+		t.Fatal("expected the matched cv to be cached after delivery")
+	}
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	if outboxBackoff(1) != outboxMinBackoff || outboxBackoff(2) != outboxMinBackoff*2 {
+		t.Fatal("expected the backoff to double every attempt")
+	}
+	if outboxBackoff(100) != outboxMaxBackoff {
+		t.Fatal("expected the backoff to be capped")
+	}
+}
@@ -0,0 +1,30 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+var (
+	sigStop = syscall.SIGSTOP
+	sigCont = syscall.SIGCONT
+	sigTerm = syscall.SIGTERM
+)
+
+// setProcessGroup makes the command the leader of a new process group
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// signalProcessGroup sends a signal to the process group of which process is the leader
+func signalProcessGroup(process *os.Process, sig syscall.Signal) error {
+	return syscall.Kill(-process.Pid, sig)
+}
+
+// killProcessGroup kills the process group of which process is the leader
+func killProcessGroup(process *os.Process) error {
+	return syscall.Kill(-process.Pid, syscall.SIGKILL)
+}
@@ -0,0 +1,27 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Windows has no SIGSTOP and SIGCONT, these values are never send
+var (
+	sigStop = syscall.Signal(0x13)
+	sigCont = syscall.Signal(0x12)
+	sigTerm = syscall.SIGTERM
+)
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func signalProcessGroup(process *os.Process, sig syscall.Signal) error {
+	return errors.New("signaling the scraper is not supported on windows")
+}
+
+func killProcessGroup(process *os.Process) error {
+	return process.Kill()
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// redisCache is a CacheBackend that stores the cache entries in a server that speaks the redis protocol (RESP)
+// All instances of the scraper client that use the same server and key prefix share their cache
+type redisCache struct {
+	address   string
+	password  string
+	db        int
+	keyPrefix string
+	timeout   time.Duration
+
+	// unavailableUntil is the unix time in nanoseconds until which commands are not sent because the server is unreachable
+	// It's read without holding the lock so callers don't have to wait for a command that is timing out
+	unavailableUntil int64
+
+	// lock is held while a command is executed as the connection can only be used by one command at a time
+	lock   sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+	// failures is the amount of commands in a row that failed because the server was unreachable
+	failures int
+}
+
+// redisMaxBackoff is the max time commands are skipped after the server was unreachable
+const redisMaxBackoff = 30 * time.Second
+
+// newRedisCache creates a new redis cache backend, the connection is made on the first command
+func newRedisCache(env EnvSharedCache) *redisCache {
+	keyPrefix := env.KeyPrefix
+	if keyPrefix == "" {
+		keyPrefix = "rtcv_scraper_client"
+	}
+
+	return &redisCache{
+		address:   env.RedisAddress,
+		password:  env.RedisPassword,
+		db:        env.RedisDB,
+		keyPrefix: keyPrefix,
+		timeout:   time.Second * 5,
+	}
+}
+
+func (c *redisCache) key(namespace, referenceNr string) string {
+	if namespace == "" {
+		namespace = defaultCacheNamespace
+	}
+	return c.keyPrefix + ":" + namespace + ":" + referenceNr
+}
+
+// Set implements CacheBackend
+func (c *redisCache) Set(namespace, referenceNr string, expires time.Time) error {
+	ttl := time.Until(expires).Milliseconds()
+	if ttl <= 0 {
+		return c.Delete(namespace, referenceNr)
+	}
+
+	_, err := c.do("SET", c.key(namespace, referenceNr), "1", "PX", strconv.FormatInt(ttl, 10))
+	return err
+}
+
+// Get implements CacheBackend
+func (c *redisCache) Get(namespace, referenceNr string) (time.Time, bool, error) {
+	reply, err := c.do("PTTL", c.key(namespace, referenceNr))
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	ttl, ok := reply.(int64)
+	if !ok {
+		return time.Time{}, false, fmt.Errorf("unexpected PTTL reply %v", reply)
+	}
+
+	switch ttl {
+	case -2:
+		// The key does not exist
+		return time.Time{}, false, nil
+	case -1:
+		// The key exists but has no expiry, this should not happen as we always set an expiry
+		return time.Now().Add(defaultCacheTTL), true, nil
+	default:
+		return time.Now().Add(time.Duration(ttl) * time.Millisecond), true, nil
+	}
+}
+
+// Delete implements CacheBackend
+func (c *redisCache) Delete(namespace, referenceNr string) error {
+	_, err := c.do("DEL", c.key(namespace, referenceNr))
+	return err
+}
+
+// do executes a command and returns the reply
+// If the command fails because of a connection error on an existing connection the connection is re-created and the command retried once
+//
+// If the server is unreachable commands fail with ErrCacheBackendUnavailable without contacting the server for a while,
+// this backoff doubles with every failure in a row up to redisMaxBackoff so a down server does not slow down every cache lookup
+func (c *redisCache) do(args ...string) (any, error) {
+	if c.unavailable() {
+		return nil, ErrCacheBackendUnavailable
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	// The server might have become unavailable while we were waiting for the lock
+	if c.unavailable() {
+		return nil, ErrCacheBackendUnavailable
+	}
+
+	for attempt := 0; ; attempt++ {
+		reused := c.conn != nil
+		reply, err := c.doOnce(args)
+		if err == nil {
+			if c.failures > 0 {
+				fmt.Println("shared cache at", c.address, "is reachable again")
+				c.failures = 0
+			}
+			return reply, nil
+		}
+
+		var replyErr redisError
+		if errors.As(err, &replyErr) {
+			return nil, err
+		}
+		if attempt > 0 || !reused {
+			c.markUnavailable(err)
+			return nil, err
+		}
+	}
+}
+
+func (c *redisCache) unavailable() bool {
+	return time.Now().UnixNano() < atomic.LoadInt64(&c.unavailableUntil)
+}
+
+// markUnavailable makes the next commands fail fast after a connection error
+// Expects the lock to be held
+func (c *redisCache) markUnavailable(err error) {
+	backoff := time.Second
+	for i := 0; i < c.failures && backoff < redisMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > redisMaxBackoff {
+		backoff = redisMaxBackoff
+	}
+	c.failures++
+
+	fmt.Printf("WARN: shared cache at %s is unreachable, skipping it for %s, error: %s\n", c.address, backoff, err)
+	atomic.StoreInt64(&c.unavailableUntil, time.Now().Add(backoff).UnixNano())
+}
+
+func (c *redisCache) doOnce(args []string) (any, error) {
+	if c.conn == nil {
+		err := c.connect()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := c.roundTrip(args)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		// The connection is in an unknown state, make a new connection on the next command
+		c.conn.Close()
+		c.conn = nil
+	}
+	return reply, err
+}
+
+func (c *redisCache) connect() error {
+	conn, err := net.DialTimeout("tcp", c.address, c.timeout)
+	if err != nil {
+		return fmt.Errorf("unable to connect to redis at %s, error: %s", c.address, err.Error())
+	}
+	c.conn = conn
+	c.reader = bufio.NewReader(conn)
+
+	if c.password != "" {
+		_, err = c.roundTrip([]string{"AUTH", c.password})
+		if err != nil {
+			c.conn.Close()
+			c.conn = nil
+			return fmt.Errorf("unable to authenticate with redis, error: %s", err.Error())
+		}
+	}
+
+	if c.db != 0 {
+		_, err = c.roundTrip([]string{"SELECT", strconv.Itoa(c.db)})
+		if err != nil {
+			c.conn.Close()
+			c.conn = nil
+			return fmt.Errorf("unable to select redis db %d, error: %s", c.db, err.Error())
+		}
+	}
+
+	return nil
+}
+
+func (c *redisCache) roundTrip(args []string) (any, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+
+	_, err := c.conn.Write(encodeRedisCommand(args))
+	if err != nil {
+		return nil, err
+	}
+
+	return readRedisReply(c.reader)
+}
+
+// redisError is an error reply send by the redis server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// encodeRedisCommand encodes a command as a RESP array of bulk strings
+func encodeRedisCommand(args []string) []byte {
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf = append(buf, "$"+strconv.Itoa(len(arg))+"\r\n"...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	return buf
+}
+
+// readRedisReply reads a single RESP reply
+// Simple strings and bulk strings are returned as string, integers as int64, arrays as []any and nil bulk strings as nil
+func readRedisReply(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if len(line) == 0 {
+		return nil, errors.New("invalid empty redis reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		data := make([]byte, size+2)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return nil, nil
+		}
+		items := make([]any, size)
+		for idx := range items {
+			items[idx], err = readRedisReply(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("unknown redis reply type %q", line[0])
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a minimal in process stand-in for a redis server that supports the commands used by redisCache
+type fakeRedis struct {
+	lock    sync.Mutex
+	entries map[string]time.Time
+}
+
+func startFakeRedis(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	checkErr(err)
+	t.Cleanup(func() { l.Close() })
+
+	server := &fakeRedis{entries: map[string]time.Time{}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func (s *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		reply, err := readRedisReply(r)
+		if err != nil {
+			return
+		}
+		args := []string{}
+		for _, arg := range reply.([]any) {
+			args = append(args, arg.(string))
+		}
+
+		s.lock.Lock()
+		var resp string
+		switch args[0] {
+		case "SET":
+			ttl, _ := strconv.Atoi(args[4])
+			s.entries[args[1]] = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+			resp = "+OK\r\n"
+		case "PTTL":
+			expires, ok := s.entries[args[1]]
+			if !ok {
+				resp = ":-2\r\n"
+			} else {
+				resp = ":" + strconv.FormatInt(time.Until(expires).Milliseconds(), 10) + "\r\n"
+			}
+		case "DEL":
+			_, ok := s.entries[args[1]]
+			delete(s.entries, args[1])
+			if ok {
+				resp = ":1\r\n"
+			} else {
+				resp = ":0\r\n"
+			}
+		default:
+			resp = "-ERR unknown command\r\n"
+		}
+		s.lock.Unlock()
+
+		conn.Write([]byte(resp))
+	}
+}
+
+func TestSharedCacheBetweenInstances(t *testing.T) {
+	address := startFakeRedis(t)
+
+	replicaA := newTestAPI(t)
+	replicaA.SharedCache = newRedisCache(EnvSharedCache{RedisAddress: address})
+	replicaB := newTestAPI(t)
+	replicaB.SharedCache = newRedisCache(EnvSharedCache{RedisAddress: address})
+
+	replicaA.SetCacheEntry("", "a", time.Hour)
+	if !replicaB.CacheEntryExists("", "a") {
+		t.Fatal("expected the reference cached by replica a to be seen by replica b")
+	}
+	if replicaB.Cache.Namespace("").Exists("a") {
+		t.Fatal("expected replica b to not copy the shared entry into its local cache")
+	}
+	if replicaB.CacheEntryExists("other", "a") {
+		t.Fatal("expected namespaces to be respected by the shared cache")
+	}
+
+	replicaA.DeleteCacheEntry("", "a")
+	if replicaB.CacheEntryExists("", "a") {
+		t.Fatal("expected the deleted reference to be removed from the shared cache")
+	}
+
+	_, err := replicaA.SharedCache.(*redisCache).do("UNKNOWN")
+	if err == nil {
+		t.Fatal("expected an error reply for an unknown command")
+	}
+}
+
+func TestSharedCacheUnavailable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	checkErr(err)
+	closedAddress := l.Addr().String()
+	l.Close()
+
+	cache := newRedisCache(EnvSharedCache{RedisAddress: closedAddress})
+	_, _, err = cache.Get("", "a")
+	if err == nil || err == ErrCacheBackendUnavailable {
+		t.Fatalf("expected a connection error but got %v", err)
+	}
+
+	// While the server is unreachable commands fail without connecting to it
+	cache.address = startFakeRedis(t)
+	_, _, err = cache.Get("", "a")
+	if err != ErrCacheBackendUnavailable {
+		t.Fatalf("expected the shared cache to be skipped but got %v", err)
+	}
+
+	cache.unavailableUntil = 0
+	checkErr(cache.Set("", "a", time.Now().Add(time.Hour)))
+	_, exists, err := cache.Get("", "a")
+	checkErr(err)
+	if !exists || cache.failures != 0 {
+		t.Fatal("expected the shared cache to be used again once it's reachable")
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// EnvRoutingRule contains the structure of a routing rule inside the routing_rules of the .env file
+//
+// Servers that are part of at least one routing rule only receive the cvs that match one of their rules,
+// servers that are not part of any routing rule receive all cvs.
+// A rule matches if all of it's conditions match, conditions that are not set always match
+type EnvRoutingRule struct {
+	// Servers contains the server_location of the servers this rule applies to
+	Servers []string `json:"servers"`
+	// ZipFrom and ZipTo are the inclusive range of the first 4 digits of personalDetails.zip
+	ZipFrom string `json:"zip_from"`
+	ZipTo   string `json:"zip_to"`
+	// Countries matches personalDetails.country, case insensitive
+	Countries []string `json:"countries"`
+	// ReferencePrefixes matches the start of the referenceNumber
+	ReferencePrefixes []string `json:"reference_prefixes"`
+}
+
+func (r *EnvRoutingRule) validate() error {
+	if len(r.Servers) == 0 {
+		return errors.New("servers is required")
+	}
+
+	if r.ZipFrom != "" {
+		_, err := parseZipNumber(r.ZipFrom)
+		if err != nil {
+			return errors.New("zip_from must start with 4 digits")
+		}
+	}
+	if r.ZipTo != "" {
+		_, err := parseZipNumber(r.ZipTo)
+		if err != nil {
+			return errors.New("zip_to must start with 4 digits")
+		}
+	}
+
+	return nil
+}
+
+// matches returns true if the cv matches all conditions of the rule
+func (r *EnvRoutingRule) matches(cv StrippedCV) bool {
+	if r.ZipFrom != "" || r.ZipTo != "" {
+		zip, err := parseZipNumber(cv.PersonalDetails.Zip)
+		if err != nil {
+			return false
+		}
+		if r.ZipFrom != "" {
+			from, _ := parseZipNumber(r.ZipFrom)
+			if zip < from {
+				return false
+			}
+		}
+		if r.ZipTo != "" {
+			to, _ := parseZipNumber(r.ZipTo)
+			if zip > to {
+				return false
+			}
+		}
+	}
+
+	if len(r.Countries) > 0 {
+		country := strings.TrimSpace(cv.PersonalDetails.Country)
+		matched := false
+		for _, ruleCountry := range r.Countries {
+			if strings.EqualFold(ruleCountry, country) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(r.ReferencePrefixes) > 0 {
+		matched := false
+		for _, prefix := range r.ReferencePrefixes {
+			if strings.HasPrefix(cv.ReferenceNumber, prefix) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	return true
+}
+
+// parseZipNumber returns the number of the first 4 digits of a dutch zip code
+func parseZipNumber(zip string) (int, error) {
+	zip = strings.TrimSpace(zip)
+	if len(zip) < 4 {
+		return 0, ErrInvalidZip
+	}
+	nr, err := strconv.Atoi(zip[:4])
+	if err != nil {
+		return 0, ErrInvalidZip
+	}
+	return nr, nil
+}
+
+// SetRoutingRules sets the rules used to decide to which servers a cv is sent
+func (a *API) SetRoutingRules(rules []EnvRoutingRule) error {
+	for idx, rule := range rules {
+		for _, server := range rule.Servers {
+			_, _, ok := a.connectionByLocation(server)
+			if !ok {
+				return fmt.Errorf("routing_rules[%d].servers contains %s which is not the server_location of the primary_server or one of the alternative_servers", idx, server)
+			}
+		}
+	}
+
+	a.routingRules = rules
+	return nil
+}
+
+// route returns for every connection if the cv should be sent to it
+func (a *API) route(cv StrippedCV) []bool {
+	routed := make([]bool, len(a.connections))
+	for idx, conn := range a.connections {
+		hasRules := false
+		for _, rule := range a.routingRules {
+			if !rule.appliesTo(conn.serverLocation) {
+				continue
+			}
+			hasRules = true
+			if rule.matches(cv) {
+				routed[idx] = true
+				break
+			}
+		}
+		if !hasRules {
+			routed[idx] = true
+		}
+	}
+	return routed
+}
+
+func (r *EnvRoutingRule) appliesTo(serverLocation string) bool {
+	for _, server := range r.Servers {
+		if server == serverLocation {
+			return true
+		}
+	}
+	return false
+}
+
+// cvsListRequests creates the allCVs request for every connection containing only the cvs routed to that connection
+// Note that a connection without routed cvs still gets a request with an empty list as that is the list of all cvs for that server
+func (a *API) cvsListRequests(cvs []StrippedCVWithOriginal) ([]*cvRequest, error) {
+	perConnection := make([][]StrippedCVWithOriginal, len(a.connections))
+	for idx := range perConnection {
+		perConnection[idx] = []StrippedCVWithOriginal{}
+	}
+	for _, cv := range cvs {
+		for idx, routed := range a.route(cv.StrippedCV) {
+			if routed {
+				perConnection[idx] = append(perConnection[idx], cv)
+			}
+		}
+	}
+
+	// Connections that receive the same cvs share a request so they end up in the same outbox item
+	reqs := make([]*cvRequest, len(a.connections))
+	reqsByBody := map[string]*cvRequest{}
+	for idx, connectionCVs := range perConnection {
+		req, err := newAllCVsRequest(connectionCVs)
+		if err != nil {
+			return nil, err
+		}
+
+		existingReq, ok := reqsByBody[string(req.Body)]
+		if ok {
+			reqs[idx] = existingReq
+			continue
+		}
+		reqs[idx] = &req
+		reqsByBody[string(req.Body)] = &req
+	}
+
+	return reqs, nil
+}
+
+// routedServers returns the server locations a cv would be sent to
+func (a *API) routedServers(cv StrippedCV) []string {
+	servers := []string{}
+	for idx, routed := range a.route(cv) {
+		if routed {
+			servers = append(servers, a.connections[idx].serverLocation)
+		}
+	}
+	return servers
+}
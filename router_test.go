@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestRouting(t *testing.T) {
+	api := newTestAPI(t)
+	checkErr(api.SetCredentials([]SetCredentialsArg{
+		{ServerLocation: "http://primary", APIKeyID: "a", APIKey: "b", Primary: true},
+		{ServerLocation: "http://north", APIKeyID: "a", APIKey: "b"},
+		{ServerLocation: "http://belgium", APIKeyID: "a", APIKey: "b"},
+	}))
+	checkErr(api.SetRoutingRules([]EnvRoutingRule{
+		{Servers: []string{"http://north"}, ZipFrom: "9000", ZipTo: "9999"},
+		{Servers: []string{"http://north"}, ReferencePrefixes: []string{"north-"}},
+		{Servers: []string{"http://belgium"}, Countries: []string{"BE", "Belgium"}},
+	}))
+
+	route := func(cv StrippedCV) string {
+		return strings.Join(api.routedServers(cv), ",")
+	}
+
+	mustEq("http://primary", route(StrippedCV{ReferenceNumber: "a", PersonalDetails: StrippedPersonalDetails{Zip: "1234AB"}}))
+	mustEq("http://primary,http://north", route(StrippedCV{ReferenceNumber: "a", PersonalDetails: StrippedPersonalDetails{Zip: "9712 CP"}}))
+	mustEq("http://primary,http://north", route(StrippedCV{ReferenceNumber: "north-1"}))
+	mustEq("http://primary,http://belgium", route(StrippedCV{ReferenceNumber: "a", PersonalDetails: StrippedPersonalDetails{Country: "belgium"}}))
+
+	err := api.SetRoutingRules([]EnvRoutingRule{{Servers: []string{"http://unknown"}}})
+	if err == nil {
+		t.Fatal("expected an error for a routing rule with an unknown server")
+	}
+}
+
+func TestCVsListRequests(t *testing.T) {
+	api := newTestAPI(t)
+	checkErr(api.SetCredentials([]SetCredentialsArg{
+		{ServerLocation: "http://primary", APIKeyID: "a", APIKey: "b", Primary: true},
+		{ServerLocation: "http://north", APIKeyID: "a", APIKey: "b"},
+	}))
+	checkErr(api.SetRoutingRules([]EnvRoutingRule{
+		{Servers: []string{"http://north"}, ZipFrom: "9000"},
+	}))
+
+	cvs := []StrippedCVWithOriginal{}
+	checkErr(json.Unmarshal([]byte(`[{"referenceNumber":"a","personalDetails":{"zip":"1234AB"}},{"referenceNumber":"b","personalDetails":{"zip":"9712CP"}}]`), &cvs))
+
+	reqs, err := api.cvsListRequests(cvs)
+	checkErr(err)
+	mustEq(`{"cvs":[{"referenceNumber":"a","personalDetails":{"zip":"1234AB"}},{"referenceNumber":"b","personalDetails":{"zip":"9712CP"}}]}`, string(reqs[0].Body))
+	mustEq(`{"cvs":[{"referenceNumber":"b","personalDetails":{"zip":"9712CP"}}]}`, string(reqs[1].Body))
+}
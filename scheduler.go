@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Overlap policies of the scheduler, they define what happens when the scraper is still running while the next run should start
+const (
+	overlapSkip         = "skip"
+	overlapQueue        = "queue"
+	overlapKillPrevious = "kill-previous"
+)
+
+var (
+	schedulerJitterLock sync.Mutex
+	schedulerJitter     = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// runSchedule returns the first time after t a run should start, implemented by cronSchedule
+type runSchedule interface {
+	next(t time.Time) (time.Time, error)
+}
+
+// SchedulerConfig contains the settings of a Scheduler
+type SchedulerConfig struct {
+	Schedules []runSchedule
+	// Overlap is one of skip, queue or kill-previous
+	Overlap string
+	// Jitter is the maximum random delay added to every run
+	Jitter time.Duration
+	// MaxRuntime is the time a run may take before it's stopped, 0 means no limit
+	MaxRuntime time.Duration
+	// KillGracePeriod is the time the scraper has to exit after it's stopped before it's killed
+	KillGracePeriod time.Duration
+}
+
+// Scheduler starts the scraper every time one of the cron schedules matches
+// At most one scraper runs at the same time, the overlap policy defines what happens if the next run should start while the scraper is still running
+type Scheduler struct {
+	scraper *ScraperProcess
+	config  SchedulerConfig
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	// done receives the result of a run
+	done chan error
+
+	lock sync.Mutex
+	// runDone is closed when the current run is done, nil if there is no run
+	runDone  chan struct{}
+	queued   bool
+	nextRun  time.Time
+	lastRun  *time.Time
+	runs     int
+	skipped  int
+	stopped  int
+	stopping bool
+}
+
+// SchedulerStatus is the response of the /schedule route
+type SchedulerStatus struct {
+	Running bool       `json:"running"`
+	Queued  bool       `json:"queued"`
+	NextRun time.Time  `json:"nextRun"`
+	LastRun *time.Time `json:"lastRun"`
+	Runs    int        `json:"runs"`
+	// Skipped is the amount of runs skipped because the previous run was still running
+	Skipped int `json:"skipped"`
+	// Stopped is the amount of runs stopped because they took longer than the max runtime or because a new run had to start
+	Stopped int `json:"stopped"`
+}
+
+// NewScheduler creates a scheduler that starts scraper every time one of the schedules in config matches
+func NewScheduler(scraper *ScraperProcess, config SchedulerConfig) *Scheduler {
+	if config.Overlap == "" {
+		config.Overlap = overlapSkip
+	}
+	if config.KillGracePeriod <= 0 {
+		config.KillGracePeriod = defaultShutdownGracePeriod
+	}
+
+	return &Scheduler{
+		scraper: scraper,
+		config:  config,
+		stop:    make(chan struct{}),
+		done:    make(chan error, 1),
+	}
+}
+
+// Run starts the scraper on the schedule until Stop is called
+// If a scraper run was in progress when the scheduler is stopped Run waits for it and returns its error
+func (s *Scheduler) Run() error {
+	next, err := s.next(time.Now())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("running %s on schedule, next run at %s\n", s.scraper, next.Format(time.RFC3339))
+	timer := time.NewTimer(time.Until(next))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			if !s.isRunning() {
+				return nil
+			}
+			return <-s.done
+		case err := <-s.done:
+			s.finishRun(err)
+			s.lock.Lock()
+			queued := s.queued
+			s.queued = false
+			s.lock.Unlock()
+			if queued {
+				s.start()
+			}
+		case <-timer.C:
+			s.trigger()
+			next, err = s.next(time.Now())
+			if err != nil {
+				return err
+			}
+			timer.Reset(time.Until(next))
+		}
+	}
+}
+
+// Stop stops the scheduler, a running scraper is not stopped
+func (s *Scheduler) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+}
+
+// next returns the time of the next run including the jitter
+func (s *Scheduler) next(now time.Time) (time.Time, error) {
+	var next time.Time
+	for _, schedule := range s.config.Schedules {
+		scheduleNext, err := schedule.next(now)
+		if err != nil {
+			continue
+		}
+		if next.IsZero() || scheduleNext.Before(next) {
+			next = scheduleNext
+		}
+	}
+	if next.IsZero() {
+		return next, errNoCronMatch
+	}
+
+	if s.config.Jitter > 0 {
+		schedulerJitterLock.Lock()
+		next = next.Add(time.Duration(schedulerJitter.Int63n(int64(s.config.Jitter))))
+		schedulerJitterLock.Unlock()
+	}
+
+	s.lock.Lock()
+	s.nextRun = next
+	s.lock.Unlock()
+	return next, nil
+}
+
+// trigger is called when a schedule matches
+func (s *Scheduler) trigger() {
+	if !s.isRunning() {
+		s.start()
+		return
+	}
+
+	switch s.config.Overlap {
+	case overlapQueue:
+		fmt.Printf("%s is still running, queueing the next run\n", s.scraper)
+		s.lock.Lock()
+		s.queued = true
+		s.lock.Unlock()
+	case overlapKillPrevious:
+		s.lock.Lock()
+		s.queued = true
+		s.lock.Unlock()
+		s.stopRun(fmt.Sprintf("%s is still running while the next run should start", s.scraper))
+	default:
+		fmt.Printf("%s is still running, skipping this run\n", s.scraper)
+		s.lock.Lock()
+		s.skipped++
+		s.lock.Unlock()
+	}
+}
+
+// start starts a new run of the scraper in the background, the result is sent to s.done
+func (s *Scheduler) start() {
+	select {
+	case <-s.stop:
+		return
+	default:
+	}
+
+	now := time.Now()
+	runDone := make(chan struct{})
+	s.lock.Lock()
+	s.runDone = runDone
+	s.lastRun = &now
+	s.runs++
+	s.stopping = false
+	s.lock.Unlock()
+
+	fmt.Printf("running %s..\n", s.scraper)
+	go func() {
+		err := s.scraper.Run()
+		close(runDone)
+		s.done <- err
+	}()
+
+	if s.config.MaxRuntime > 0 {
+		go func() {
+			select {
+			case <-runDone:
+			case <-time.After(s.config.MaxRuntime):
+				s.stopRun(fmt.Sprintf("%s is running for more than %s", s.scraper, s.config.MaxRuntime))
+			}
+		}()
+	}
+}
+
+// stopRun stops the current run, if the scraper does not exit within the kill grace period it's killed
+func (s *Scheduler) stopRun(reason string) {
+	s.lock.Lock()
+	runDone := s.runDone
+	if runDone == nil || s.stopping {
+		s.lock.Unlock()
+		return
+	}
+	s.stopping = true
+	s.stopped++
+	s.lock.Unlock()
+
+	fmt.Printf("%s, stopping %s..\n", reason, s.scraper)
+	err := s.scraper.Stop()
+	if err != nil && err != ErrScraperNotRunning {
+		fmt.Printf("WARN: unable to stop %s, error: %s\n", s.scraper, err)
+	}
+
+	go func() {
+		select {
+		case <-runDone:
+		case <-time.After(s.config.KillGracePeriod):
+			fmt.Printf("%s did not exit within %s, killing it..\n", s.scraper, s.config.KillGracePeriod)
+			err := s.scraper.Kill()
+			if err != nil && err != ErrScraperNotRunning {
+				fmt.Printf("WARN: unable to kill %s, error: %s\n", s.scraper, err)
+			}
+		}
+	}()
+}
+
+func (s *Scheduler) finishRun(err error) {
+	code, exited := exitCode(err)
+	if exited {
+		fmt.Printf("%s exited with code %d\n", s.scraper, code)
+	} else {
+		fmt.Printf("WARN: unable to run %s, error: %s\n", s.scraper, err)
+	}
+
+	s.lock.Lock()
+	s.runDone = nil
+	s.stopping = false
+	s.lock.Unlock()
+}
+
+func (s *Scheduler) isRunning() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.runDone != nil
+}
+
+// Status returns the state of the scheduler
+func (s *Scheduler) Status() SchedulerStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return SchedulerStatus{
+		Running: s.runDone != nil,
+		Queued:  s.queued,
+		NextRun: s.nextRun,
+		LastRun: s.lastRun,
+		Runs:    s.runs,
+		Skipped: s.skipped,
+		Stopped: s.stopped,
+	}
+}
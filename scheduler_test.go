@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func waitForSchedulerRun(t *testing.T, s *Scheduler) {
+	select {
+	case err := <-s.done:
+		s.finishRun(err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the scraper run to finish")
+	}
+}
+
+// intervalSchedule is a runSchedule that matches every interval, unlike cron expressions it allows runs less than a minute apart
+type intervalSchedule time.Duration
+
+func (i intervalSchedule) next(t time.Time) (time.Time, error) {
+	return t.Add(time.Duration(i)), nil
+}
+
+func TestSchedulerRunQueue(t *testing.T) {
+	scraper := NewScraperProcess("", []string{"sleep", "0.3"}, os.Environ())
+	s := NewScheduler(scraper, SchedulerConfig{
+		Schedules:       []runSchedule{intervalSchedule(100 * time.Millisecond)},
+		Overlap:         overlapQueue,
+		KillGracePeriod: time.Second,
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Run()
+	}()
+
+	// The schedule matches while the first run is still going, the queued run should start once it's done
+	deadline := time.Now().Add(5 * time.Second)
+	for s.Status().Runs < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the queued run to be started but got %+v", s.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	status := s.Status()
+	if status.Skipped != 0 || status.Stopped != 0 {
+		t.Fatalf("expected no runs to be skipped or stopped but got %+v", status)
+	}
+
+	s.Stop()
+	err := scraper.Stop()
+	if err != nil && err != ErrScraperNotRunning {
+		checkErr(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Run to return after the scheduler is stopped")
+	}
+}
+
+func TestSchedulerOverlap(t *testing.T) {
+	newScheduler := func(overlap string) *Scheduler {
+		scraper := NewScraperProcess("", []string{"sleep", "10"}, os.Environ())
+		return NewScheduler(scraper, SchedulerConfig{Overlap: overlap, KillGracePeriod: time.Second})
+	}
+
+	s := newScheduler(overlapSkip)
+	s.trigger()
+	waitForScraperState(t, s.scraper, scraperRunning)
+	s.trigger()
+	status := s.Status()
+	if !status.Running || status.Queued || status.Skipped != 1 {
+		t.Fatalf("expected the second run to be skipped but got %+v", status)
+	}
+	s.stopRun("test")
+	waitForSchedulerRun(t, s)
+
+	s = newScheduler(overlapQueue)
+	s.trigger()
+	waitForScraperState(t, s.scraper, scraperRunning)
+	s.trigger()
+	if !s.Status().Queued {
+		t.Fatal("expected the second run to be queued")
+	}
+	s.stopRun("test")
+	waitForSchedulerRun(t, s)
+
+	s = newScheduler(overlapKillPrevious)
+	s.trigger()
+	waitForScraperState(t, s.scraper, scraperRunning)
+	s.trigger()
+	waitForSchedulerRun(t, s)
+	status = s.Status()
+	if !status.Queued || status.Stopped != 1 {
+		t.Fatalf("expected the previous run to be stopped and the next run to be queued but got %+v", status)
+	}
+}
+
+func TestSchedulerMaxRuntime(t *testing.T) {
+	scraper := NewScraperProcess("", []string{"sleep", "10"}, os.Environ())
+	s := NewScheduler(scraper, SchedulerConfig{MaxRuntime: 100 * time.Millisecond, KillGracePeriod: time.Second})
+
+	s.trigger()
+	waitForSchedulerRun(t, s)
+	status := s.Status()
+	if status.Running || status.Runs != 1 || status.Stopped != 1 {
+		t.Fatalf("expected the run to be stopped after the max runtime but got %+v", status)
+	}
+}
@@ -0,0 +1,589 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Scraper process states
+const (
+	scraperNotStarted = "not_started"
+	scraperRunning    = "running"
+	scraperPaused     = "paused"
+	scraperStopping   = "stopping"
+	scraperRestarting = "restarting"
+	// scraperStopped means the scraper was stopped using StopUntilRestart and waits for Restart
+	scraperStopped = "stopped"
+	scraperExited  = "exited"
+)
+
+// Restart policies of the scraper process
+const (
+	restartNever     = "never"
+	restartOnFailure = "on-failure"
+	restartAlways    = "always"
+)
+
+// restartCounterReset is how long the scraper needs to run before the restart backoff and max restarts counter are reset
+const restartCounterReset = 10 * time.Minute
+
+// RestartPolicy defines if and when the scraper is started again after it exits on its own
+type RestartPolicy struct {
+	// Policy is one of never, on-failure or always
+	Policy string
+	// MaxRestarts is the amount of times the scraper is restarted in a row before giving up, 0 means no limit
+	MaxRestarts int
+	// Backoff is the time to wait before the first restart, it's doubled after every restart in a row
+	Backoff time.Duration
+	// MaxBackoff caps the time to wait before a restart
+	MaxBackoff time.Duration
+}
+
+func (r RestartPolicy) withDefaults() RestartPolicy {
+	if r.Policy == "" {
+		r.Policy = restartNever
+	}
+	if r.Backoff <= 0 {
+		r.Backoff = time.Second
+	}
+	if r.MaxBackoff <= 0 {
+		r.MaxBackoff = time.Minute
+	}
+	if r.MaxBackoff < r.Backoff {
+		r.MaxBackoff = r.Backoff
+	}
+	return r
+}
+
+// shouldRestart returns if the scraper should be started again after it exited with exitCode
+func (r RestartPolicy) shouldRestart(exitCode int, restartsInARow int) bool {
+	if r.MaxRestarts > 0 && restartsInARow >= r.MaxRestarts {
+		return false
+	}
+	switch r.Policy {
+	case restartAlways:
+		return true
+	case restartOnFailure:
+		return exitCode != 0
+	default:
+		return false
+	}
+}
+
+// backoff returns the time to wait before restarting the scraper for the attempt time in a row
+func (r RestartPolicy) backoff(attempt int) time.Duration {
+	delay := r.Backoff
+	for i := 0; i < attempt && delay < r.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > r.MaxBackoff {
+		delay = r.MaxBackoff
+	}
+	return delay
+}
+
+// ErrScraperNotRunning is returned when trying to control a scraper process that is not running
+var ErrScraperNotRunning = errors.New("the scraper is not running")
+
+// ScraperProcess is the scraper command started by the client
+type ScraperProcess struct {
+	name string
+	args []string
+	env  []string
+	// logs captures the output of the scraper, if nil the output is passed as is to the stdout and stderr of the client
+	logs *Logs
+
+	lock  sync.Mutex
+	cmd   *exec.Cmd
+	state string
+	// startedAt is the time the current process was started
+	startedAt time.Time
+	// stateChanged is closed and replaced every time the state changes
+	stateChanged chan struct{}
+	// restart is set when the scraper should be started again after it exits
+	restart bool
+	// hold is set when Run should wait for Restart after the scraper exits instead of returning, see StopUntilRestart
+	hold bool
+
+	policy         RestartPolicy
+	restarts       int
+	restartsInARow int
+	lastExitCode   *int
+	lastExitAt     *time.Time
+}
+
+// ScraperStatus is the response of the /scraper route
+type ScraperStatus struct {
+	// Name is empty if the client runs the scraper command passed as arguments
+	Name  string `json:"name,omitempty"`
+	State string `json:"state"`
+	// Restarts is the amount of times the scraper was started again, this includes restarts requested by RT-CV
+	Restarts     int        `json:"restarts"`
+	LastExitCode *int       `json:"lastExitCode"`
+	LastExitAt   *time.Time `json:"lastExitAt"`
+	// Schedule is only set if the scraper runs on a schedule
+	Schedule *SchedulerStatus `json:"schedule,omitempty"`
+	// Watchdog is only set if the scraper has limits
+	Watchdog *WatchdogStatus `json:"watchdog,omitempty"`
+}
+
+// NewScraperProcess creates a scraper process that runs args with the environment variables env
+// The name is used in log messages and can be empty if the client runs only one scraper
+func NewScraperProcess(name string, args []string, env []string) *ScraperProcess {
+	return &ScraperProcess{
+		name:         name,
+		args:         args,
+		env:          env,
+		state:        scraperNotStarted,
+		stateChanged: make(chan struct{}),
+		policy:       RestartPolicy{}.withDefaults(),
+	}
+}
+
+// String returns the name of the scraper as used in log messages
+func (p *ScraperProcess) String() string {
+	if p.name == "" {
+		return "scraper"
+	}
+	return "scraper " + p.name
+}
+
+// SetLogs makes the output of the scraper be captured by logs, should be called before Run
+func (p *ScraperProcess) SetLogs(logs *Logs) {
+	p.lock.Lock()
+	p.logs = logs
+	p.lock.Unlock()
+}
+
+// SetRestartPolicy changes when the scraper is started again after it exits, should be called before Run
+func (p *ScraperProcess) SetRestartPolicy(policy RestartPolicy) {
+	p.lock.Lock()
+	p.policy = policy.withDefaults()
+	p.lock.Unlock()
+}
+
+// Run starts the scraper and waits for it to exit
+// The scraper is started again if requested using Restart or if the restart policy says so
+// If the scraper was stopped using StopUntilRestart Run waits until Restart, Stop or Kill is called
+// Returns the error of the last time the scraper exited
+func (p *ScraperProcess) Run() error {
+	p.lock.Lock()
+	p.restartsInARow = 0
+	p.lock.Unlock()
+
+	for {
+		startedAt := time.Now()
+		err := p.runOnce()
+		code, exited := exitCode(err)
+
+		p.lock.Lock()
+		if exited {
+			exitedAt := time.Now()
+			p.lastExitCode = &code
+			p.lastExitAt = &exitedAt
+		}
+		if time.Since(startedAt) > restartCounterReset {
+			p.restartsInARow = 0
+		}
+
+		var delay time.Duration
+		restart := p.restart
+		p.restart = false
+		if !restart && exited && p.state != scraperStopping && p.policy.shouldRestart(code, p.restartsInARow) {
+			restart = true
+			delay = p.policy.backoff(p.restartsInARow)
+			p.restartsInARow++
+			p.setState(scraperRestarting)
+		}
+		if restart {
+			p.restarts++
+		} else if p.hold {
+			p.setState(scraperStopped)
+		} else {
+			p.setState(scraperExited)
+		}
+		p.lock.Unlock()
+
+		if !restart {
+			if !p.waitForRestart() {
+				return err
+			}
+		} else if delay > 0 {
+			fmt.Printf("%s exited with code %d, restarting in %s..\n", p, code, delay)
+			if !p.waitBeforeRestart(delay) && !p.waitForRestart() {
+				return err
+			}
+		}
+		fmt.Printf("restarting %s..\n", p)
+	}
+}
+
+// waitBeforeRestart waits for delay, the wait is cut short by Restart and canceled by Stop
+// Returns false if the restart is canceled
+func (p *ScraperProcess) waitBeforeRestart(delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	elapsed := false
+	for {
+		p.lock.Lock()
+		state := p.state
+		restart := elapsed || p.restart
+		if state != scraperRestarting {
+			if !p.hold {
+				p.setState(scraperExited)
+			}
+		} else if restart {
+			p.restart = false
+		}
+		changed := p.stateChanged
+		p.lock.Unlock()
+
+		if state != scraperRestarting {
+			return false
+		}
+		if restart {
+			return true
+		}
+
+		select {
+		case <-timer.C:
+			elapsed = true
+		case <-changed:
+		}
+	}
+}
+
+// waitForRestart keeps a scraper stopped by StopUntilRestart stopped until Restart is called
+// Returns false if the scraper is not held or if Stop or Kill is called in the meantime
+func (p *ScraperProcess) waitForRestart() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if !p.hold {
+		return false
+	}
+	fmt.Printf("%s is stopped, waiting for a restart request\n", p)
+
+	for {
+		if p.restart {
+			p.restart = false
+			p.hold = false
+			p.restarts++
+			return true
+		}
+		if !p.hold {
+			p.setState(scraperExited)
+			return false
+		}
+		if p.state != scraperStopped {
+			p.setState(scraperStopped)
+		}
+
+		changed := p.stateChanged
+		p.lock.Unlock()
+		<-changed
+		p.lock.Lock()
+	}
+}
+
+// exitCode returns the exit code of the scraper based on the error returned by Run
+// exited is false if the error was not caused by the scraper exiting, for example if the command could not be started
+func exitCode(err error) (code int, exited bool) {
+	if err == nil {
+		return 0, true
+	}
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return 0, false
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok {
+		return exitErr.ExitCode(), true
+	}
+	if status.Signaled() {
+		// Follow the shell convention for processes killed by a signal
+		return 128 + int(status.Signal()), true
+	}
+	return status.ExitStatus(), true
+}
+
+// stdinIsTerminal returns true if the stdin of the client is a terminal
+func stdinIsTerminal() bool {
+	stat, err := os.Stdin.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
+func (p *ScraperProcess) runOnce() error {
+	cmd := exec.Command(p.args[0], p.args[1:]...)
+	cmd.Env = p.env
+
+	// The scraper runs in it's own process group, which is a background process group when the client runs in a terminal.
+	// Reading from the terminal would stop the scraper with SIGTTIN so in that case it gets no stdin (/dev/null)
+	cmd.Stdin = os.Stdin
+	if stdinIsTerminal() {
+		cmd.Stdin = nil
+	}
+
+	// Piple output of scraper to stdout
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	closePipes := func() {}
+	if p.logs != nil {
+		var err error
+		closePipes, err = p.logs.capture(cmd, p.name)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The scraper gets it's own process group so we can signal the scraper and all processes it started
+	setProcessGroup(cmd)
+
+	p.lock.Lock()
+	err := cmd.Start()
+	closePipes()
+	if err != nil {
+		p.lock.Unlock()
+		return err
+	}
+	p.cmd = cmd
+	p.startedAt = time.Now()
+	p.setState(scraperRunning)
+	p.lock.Unlock()
+
+	return cmd.Wait()
+}
+
+// setState must be called while holding the lock
+func (p *ScraperProcess) setState(state string) {
+	p.state = state
+	close(p.stateChanged)
+	p.stateChanged = make(chan struct{})
+}
+
+// Pause suspends the scraper and all processes it started
+func (p *ScraperProcess) Pause() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	switch p.state {
+	case scraperPaused:
+		return nil
+	case scraperRunning:
+		err := signalProcessGroup(p.cmd.Process, sigStop)
+		if err != nil {
+			return err
+		}
+		p.setState(scraperPaused)
+		return nil
+	default:
+		return ErrScraperNotRunning
+	}
+}
+
+// Resume continues a paused scraper
+func (p *ScraperProcess) Resume() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	switch p.state {
+	case scraperRunning:
+		return nil
+	case scraperPaused:
+		err := signalProcessGroup(p.cmd.Process, sigCont)
+		if err != nil {
+			return err
+		}
+		p.setState(scraperRunning)
+		return nil
+	default:
+		return ErrScraperNotRunning
+	}
+}
+
+// Stop gracefully stops the scraper by sending SIGTERM to the scraper and all processes it started
+// Stop does not wait for the scraper to exit, use WaitForState for that
+func (p *ScraperProcess) Stop() error {
+	return p.StopWithSignal(sigTerm)
+}
+
+// StopWithSignal stops the scraper by sending sig to the scraper and all processes it started
+// The scraper is not restarted after it exits
+func (p *ScraperProcess) StopWithSignal(sig syscall.Signal) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	err := p.terminate(scraperStopping, sig)
+	if err != nil {
+		return err
+	}
+	p.restart = false
+	p.hold = false
+	return nil
+}
+
+// StopUntilRestart gracefully stops the scraper like Stop but Run keeps waiting for Restart instead of returning
+// This keeps the client running after RT-CV stopped the scraper so RT-CV can start it again later on
+func (p *ScraperProcess) StopUntilRestart() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	err := p.terminate(scraperStopping, sigTerm)
+	if err != nil {
+		return err
+	}
+	p.restart = false
+	p.hold = true
+	return nil
+}
+
+// Restart stops the scraper and starts it again once it exited, a scraper stopped by StopUntilRestart is started again
+// Restart does not wait for the new scraper to be started, use WaitForState for that
+func (p *ScraperProcess) Restart() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	err := p.terminate(scraperRestarting, sigTerm)
+	if err != nil {
+		return err
+	}
+	p.restart = true
+	return nil
+}
+
+// terminate must be called while holding the lock
+func (p *ScraperProcess) terminate(newState string, sig syscall.Signal) error {
+	switch p.state {
+	case scraperStopping, scraperRestarting, scraperStopped:
+		p.setState(newState)
+		return nil
+	case scraperRunning, scraperPaused:
+		err := signalProcessGroup(p.cmd.Process, sig)
+		if err != nil {
+			return err
+		}
+		if p.state == scraperPaused {
+			// A suspended process only handles the signal after it's continued
+			err = signalProcessGroup(p.cmd.Process, sigCont)
+			if err != nil {
+				return err
+			}
+		}
+		p.setState(newState)
+		return nil
+	default:
+		return ErrScraperNotRunning
+	}
+}
+
+// Kill immediately kills the scraper and all processes it started
+// The scraper is not restarted after it exits
+func (p *ScraperProcess) Kill() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	switch p.state {
+	case scraperStopped:
+		p.hold = false
+		p.setState(scraperStopping)
+		return nil
+	case scraperRunning, scraperPaused, scraperStopping, scraperRestarting:
+		p.restart = false
+		p.hold = false
+		err := killProcessGroup(p.cmd.Process)
+		if err != nil && (p.state == scraperRunning || p.state == scraperPaused) {
+			// While stopping or restarting the scraper might already have exited
+			return err
+		}
+		p.setState(scraperStopping)
+		return nil
+	default:
+		return ErrScraperNotRunning
+	}
+}
+
+// Abort immediately kills the scraper and all processes it started
+// Unlike Kill the scraper is handled as if it crashed, so the restart policy still applies
+func (p *ScraperProcess) Abort() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	switch p.state {
+	case scraperRunning, scraperPaused:
+		return killProcessGroup(p.cmd.Process)
+	default:
+		return ErrScraperNotRunning
+	}
+}
+
+// process returns the current process of the scraper, the time it was started and the state of the scraper
+// The process is nil if the scraper is not running or paused
+func (p *ScraperProcess) process() (*os.Process, time.Time, string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if p.state != scraperRunning && p.state != scraperPaused {
+		return nil, time.Time{}, p.state
+	}
+	return p.cmd.Process, p.startedAt, p.state
+}
+
+// WaitForState waits until the scraper is in one of states or until the timeout is reached
+// Returns the state the scraper is in
+func (p *ScraperProcess) WaitForState(timeout time.Duration, states ...string) string {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		p.lock.Lock()
+		state := p.state
+		changed := p.stateChanged
+		p.lock.Unlock()
+
+		for _, expected := range states {
+			if state == expected {
+				return state
+			}
+		}
+
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return state
+		}
+	}
+}
+
+// State returns one of not_started, running, paused, stopping, restarting, stopped or exited
+func (p *ScraperProcess) State() string {
+	if p == nil {
+		return scraperNotStarted
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.state
+}
+
+// Status returns the state of the scraper and how often it was restarted
+func (p *ScraperProcess) Status() ScraperStatus {
+	if p == nil {
+		return ScraperStatus{State: scraperNotStarted}
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return ScraperStatus{
+		Name:         p.name,
+		State:        p.state,
+		Restarts:     p.restarts,
+		LastExitCode: p.lastExitCode,
+		LastExitAt:   p.lastExitAt,
+	}
+}
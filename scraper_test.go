@@ -0,0 +1,202 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// processState returns the state letter of a process from /proc, for example S for sleeping and T for stopped
+func processState(t *testing.T, pid int) string {
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		t.Skip("/proc is not available")
+	}
+	// The state comes after the command name which is wrapped in parentheses
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return fields[0]
+}
+
+func waitForScraperState(t *testing.T, p *ScraperProcess, state string) {
+	for i := 0; p.State() != state && i < 500; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	mustEq(state, p.State())
+}
+
+func TestScraperProcessPauseResume(t *testing.T) {
+	p := NewScraperProcess("", []string{"sleep", "10"}, os.Environ())
+	err := p.Pause()
+	if err != ErrScraperNotRunning {
+		t.Fatalf("expected ErrScraperNotRunning but got %v", err)
+	}
+
+	go p.Run()
+	waitForScraperState(t, p, scraperRunning)
+	defer p.cmd.Process.Kill()
+	pid := p.cmd.Process.Pid
+
+	checkErr(p.Pause())
+	mustEq(scraperPaused, p.State())
+	// Signals are delivered asynchronously
+	for i := 0; processState(t, pid) != "T" && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	mustEq("T", processState(t, pid))
+
+	checkErr(p.Resume())
+	mustEq(scraperRunning, p.State())
+	for i := 0; processState(t, pid) == "T" && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if processState(t, pid) == "T" {
+		t.Fatal("expected the process to be resumed")
+	}
+}
+
+func TestScraperProcessStopRestart(t *testing.T) {
+	p := NewScraperProcess("", []string{"sleep", "10"}, os.Environ())
+	if p.Restart() != ErrScraperNotRunning {
+		t.Fatal("expected restarting a scraper that is not started to fail")
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- p.Run()
+	}()
+	waitForScraperState(t, p, scraperRunning)
+	firstPid := p.cmd.Process.Pid
+
+	checkErr(p.Restart())
+	mustEq(scraperRunning, p.WaitForState(5*time.Second, scraperRunning, scraperExited))
+	p.lock.Lock()
+	secondPid := p.cmd.Process.Pid
+	p.lock.Unlock()
+	if firstPid == secondPid {
+		t.Fatal("expected the scraper to be started again")
+	}
+
+	// A paused scraper should also be stopped
+	checkErr(p.Pause())
+	checkErr(p.Stop())
+	mustEq(scraperExited, p.WaitForState(5*time.Second, scraperExited))
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Fatal("expected Run to return after the scraper is stopped")
+	}
+}
+
+func TestScraperProcessStopUntilRestart(t *testing.T) {
+	p := NewScraperProcess("", []string{"sleep", "10"}, os.Environ())
+	exited := make(chan error, 1)
+	go func() {
+		exited <- p.Run()
+	}()
+	waitForScraperState(t, p, scraperRunning)
+
+	checkErr(p.StopUntilRestart())
+	mustEq(scraperStopped, p.WaitForState(5*time.Second, scraperStopped, scraperExited))
+	if p.Pause() != ErrScraperNotRunning {
+		t.Fatal("expected pausing a stopped scraper to fail")
+	}
+
+	// Restart starts a stopped scraper again
+	checkErr(p.Restart())
+	mustEq(scraperRunning, p.WaitForState(5*time.Second, scraperRunning, scraperExited))
+
+	// Stop ends a stopped scraper for good
+	checkErr(p.StopUntilRestart())
+	mustEq(scraperStopped, p.WaitForState(5*time.Second, scraperStopped, scraperExited))
+	checkErr(p.Stop())
+	select {
+	case <-exited:
+	case <-time.After(time.Second):
+		t.Fatal("expected Run to return after a stopped scraper is stopped")
+	}
+	mustEq(scraperExited, p.State())
+}
+
+func TestScraperRestartPolicy(t *testing.T) {
+	p := NewScraperProcess("", []string{"sh", "-c", "exit 3"}, os.Environ())
+	p.SetRestartPolicy(RestartPolicy{
+		Policy:      restartOnFailure,
+		MaxRestarts: 2,
+		Backoff:     time.Millisecond,
+	})
+	err := p.Run()
+	code, exited := exitCode(err)
+	if !exited || code != 3 {
+		t.Fatalf("expected the scraper to exit with code 3 but got %d, error: %v", code, err)
+	}
+
+	status := p.Status()
+	mustEq(scraperExited, status.State)
+	if status.Restarts != 2 || status.LastExitCode == nil || *status.LastExitCode != 3 {
+		t.Fatalf("expected 2 restarts and exit code 3 but got %+v", status)
+	}
+
+	// Exiting successfully should not cause a restart with the on-failure policy
+	p = NewScraperProcess("", []string{"true"}, os.Environ())
+	p.SetRestartPolicy(RestartPolicy{Policy: restartOnFailure, Backoff: time.Millisecond})
+	checkErr(p.Run())
+	if p.Status().Restarts != 0 {
+		t.Fatal("expected the scraper not to be restarted")
+	}
+}
+
+func TestScraperStopCancelsRestart(t *testing.T) {
+	p := NewScraperProcess("", []string{"true"}, os.Environ())
+	p.SetRestartPolicy(RestartPolicy{Policy: restartAlways, Backoff: time.Hour})
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- p.Run()
+	}()
+	waitForScraperState(t, p, scraperRestarting)
+
+	checkErr(p.Stop())
+	select {
+	case err := <-exited:
+		checkErr(err)
+	case <-time.After(time.Second):
+		t.Fatal("expected Run to return after the restart is canceled")
+	}
+	mustEq(scraperExited, p.State())
+}
+
+func TestRestartPolicyBackoff(t *testing.T) {
+	policy := RestartPolicy{Backoff: time.Second, MaxBackoff: 5 * time.Second}.withDefaults()
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}
+	for attempt, delay := range expected {
+		mustEq(delay.String(), policy.backoff(attempt).String())
+	}
+	mustEq("5s", policy.backoff(100).String())
+}
+
+func TestScraperKill(t *testing.T) {
+	// The scraper ignores SIGTERM so it has to be killed
+	p := NewScraperProcess("", []string{"sh", "-c", `trap "" TERM; sleep 10`}, os.Environ())
+	p.SetRestartPolicy(RestartPolicy{Policy: restartAlways})
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- p.Run()
+	}()
+	waitForScraperState(t, p, scraperRunning)
+
+	checkErr(p.StopWithSignal(sigTerm))
+	mustEq(scraperStopping, p.WaitForState(200*time.Millisecond, scraperExited))
+
+	checkErr(p.Kill())
+	select {
+	case err := <-exited:
+		code, _ := exitCode(err)
+		mustEq("137", strconv.Itoa(code))
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected Run to return after the scraper is killed")
+	}
+	mustEq(scraperExited, p.State())
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Scraper is a scraper command supervised by the client
+type Scraper struct {
+	// Name is used in the path prefix of the SCRAPER_ADDRESS of the scraper
+	// It's empty if the client runs the scraper command passed as arguments
+	Name string
+	// CacheNamespace is used for requests of the scraper that do not specify a cache namespace
+	CacheNamespace string
+	// Users are the login users returned by /users, nil means all login users
+	Users []EnvUser
+
+	Process *ScraperProcess
+	// Scheduler starts the scraper on a schedule, nil if the scraper only runs once
+	Scheduler *Scheduler
+	// Watchdog kills the scraper if it exceeds its limits, nil if the scraper has no limits
+	Watchdog *Watchdog
+}
+
+// newScraper creates a scraper based on its config inside the .env file
+// address is the address of the local webserver
+// Returns an error if the scraper is limited to a login user that does not exist
+func (a *API) newScraper(env Env, config EnvScraper, address string, loginUsers []EnvUser, killGracePeriod time.Duration) (*Scraper, error) {
+	scraper := &Scraper{
+		Name:           config.Name,
+		CacheNamespace: config.CacheNamespace,
+	}
+
+	processEnv := os.Environ()
+	if config.Name != "" {
+		address += scraperPathPrefix(config.Name)
+		processEnv = append(processEnv, "SCRAPER_NAME="+config.Name)
+		if scraper.CacheNamespace == "" {
+			scraper.CacheNamespace = config.Name
+		}
+	}
+	processEnv = append(processEnv, "SCRAPER_ADDRESS="+address)
+
+	if config.Users != nil {
+		scraper.Users = []EnvUser{}
+		for _, username := range config.Users {
+			found := false
+			for _, user := range loginUsers {
+				if user.Username == username {
+					scraper.Users = append(scraper.Users, user)
+					found = true
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("login user %s of scraper %s does not exist", username, config.Name)
+			}
+		}
+	}
+
+	scraper.Process = NewScraperProcess(config.Name, config.Command, processEnv)
+	scraper.Process.SetRestartPolicy(env.restartPolicy())
+	if a.Logs != nil {
+		scraper.Process.SetLogs(a.Logs)
+	}
+
+	schedule := env.Schedule
+	if config.Schedule != nil {
+		schedule = config.Schedule
+	}
+	if schedule != nil {
+		scraper.Scheduler = NewScheduler(scraper.Process, schedule.toSchedulerConfig(killGracePeriod))
+	}
+
+	watchdog := env.Watchdog
+	if config.Watchdog != nil {
+		watchdog = config.Watchdog
+	}
+	if watchdog != nil {
+		scraper.Watchdog = NewWatchdog(scraper.Process, watchdog.toWatchdogConfig(), func(violation WatchdogViolation) {
+			a.SendWebsocketEvent("scraper_watchdog", violation)
+		})
+	}
+
+	return scraper, nil
+}
+
+// Run runs the scraper once or, if the scraper has a schedule, until the scheduler is stopped
+func (s *Scraper) Run() error {
+	if s.Watchdog != nil {
+		go s.Watchdog.Run()
+		defer s.Watchdog.Stop()
+	}
+	if s.Scheduler != nil {
+		return s.Scheduler.Run()
+	}
+	fmt.Printf("running %s..\n", s.Process)
+	return s.Process.Run()
+}
+
+// Status returns the state of the scraper process and its schedule
+func (s *Scraper) Status() ScraperStatus {
+	status := s.Process.Status()
+	if s.Scheduler != nil {
+		schedule := s.Scheduler.Status()
+		status.Schedule = &schedule
+	}
+	if s.Watchdog != nil {
+		watchdog := s.Watchdog.Status()
+		status.Watchdog = &watchdog
+	}
+	return status
+}
+
+// Stop stops the scheduler and sends sig to the scraper
+func (s *Scraper) Stop(sig syscall.Signal) error {
+	if s.Scheduler != nil {
+		s.Scheduler.Stop()
+	}
+	return s.Process.StopWithSignal(sig)
+}
+
+// scraperPathPrefix is the path prefix of the local webserver routes of a named scraper
+func scraperPathPrefix(name string) string {
+	return "/scrapers/" + name
+}
+
+// findScraper returns the scraper with name or nil if there is no such scraper
+func (a *API) findScraper(name string) *Scraper {
+	for _, scraper := range a.Scrapers {
+		if scraper.Name == name {
+			return scraper
+		}
+	}
+	return nil
+}
+
+// onlyScraper returns the scraper if the client runs exactly one scraper
+func (a *API) onlyScraper() *Scraper {
+	if len(a.Scrapers) != 1 {
+		return nil
+	}
+	return a.Scrapers[0]
+}
+
+// scraperActivity tells the watchdog of scraper the scraper is active
+// If scraper is nil the request can't be attributed to a scraper so it counts for all of them
+func (a *API) scraperActivity(scraper *Scraper) {
+	for _, s := range a.Scrapers {
+		if s.Watchdog != nil && (scraper == nil || s == scraper) {
+			s.Watchdog.Touch()
+		}
+	}
+}
+
+// ScraperStatuses returns the status of every scraper
+func (a *API) ScraperStatuses() []ScraperStatus {
+	statuses := make([]ScraperStatus, len(a.Scrapers))
+	for idx, scraper := range a.Scrapers {
+		statuses[idx] = scraper.Status()
+	}
+	return statuses
+}
+
+// RunScrapers runs all scrapers and waits for them to finish
+// Returns the first error of the scrapers in the order they are configured
+func (a *API) RunScrapers() error {
+	errs := make([]error, len(a.Scrapers))
+	var wg sync.WaitGroup
+	for idx, scraper := range a.Scrapers {
+		wg.Add(1)
+		go func(idx int, scraper *Scraper) {
+			errs[idx] = scraper.Run()
+			wg.Done()
+		}(idx, scraper)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
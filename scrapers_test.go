@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func post(t *testing.T, url string, body string) (int, string) {
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	resp := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI(url)
+	req.Header.SetMethod("POST")
+	req.SetBodyString(body)
+	checkErr(fasthttp.DoTimeout(req, resp, 5*time.Second))
+	return resp.StatusCode(), string(resp.Body())
+}
+
+func TestMultipleScrapers(t *testing.T) {
+	api := newTestAPI(t)
+	api.SetMockMode()
+	loginUsers := []EnvUser{{Username: "a", Password: "1"}, {Username: "b", Password: "2"}}
+	address, listener := listenWebserver()
+
+	env := Env{}
+	for _, config := range []EnvScraper{
+		{Name: "site-a", Command: []string{"sleep", "10"}, Users: []string{"a"}},
+		{Name: "site-b", Command: []string{"sleep", "10"}},
+	} {
+		scraper, err := api.newScraper(env, config, address, loginUsers, time.Second)
+		checkErr(err)
+		api.Scrapers = append(api.Scrapers, scraper)
+	}
+	_, err := api.newScraper(env, EnvScraper{Name: "site-c", Command: []string{"true"}, Users: []string{"c"}}, address, loginUsers, time.Second)
+	if err == nil {
+		t.Fatal("expected a scraper with an unknown login user to be rejected")
+	}
+	server := serveWebserver(env, api, loginUsers, listener)
+	defer server.Shutdown()
+	processEnv := api.Scrapers[0].Process.env
+	mustEq("SCRAPER_ADDRESS="+address+"/scrapers/site-a", processEnv[len(processEnv)-1])
+
+	// The users of a scraper can be limited
+	_, body := post(t, address+"/scrapers/site-a/users", "")
+	mustEq(`[{"username":"a","password":"1"}]`, body)
+	_, body = post(t, address+"/scrapers/site-b/users", "")
+	mustEq(`[{"username":"a","password":"1"},{"username":"b","password":"2"}]`, body)
+
+	// Every scraper uses its own cache namespace by default
+	_, body = post(t, address+"/scrapers/site-a/set_cached_reference", "abc")
+	mustEq("true", body)
+	_, body = post(t, address+"/scrapers/site-a/get_cached_reference", "abc")
+	mustEq("true", body)
+	_, body = post(t, address+"/scrapers/site-b/get_cached_reference", "abc")
+	mustEq("false", body)
+	if !api.CacheEntryExists("site-a", "abc") {
+		t.Fatal("expected the reference to be cached in the namespace of the scraper")
+	}
+
+	statusCode, _ := post(t, address+"/scrapers/unknown/users", "")
+	if statusCode != 404 {
+		t.Fatalf("expected an unknown scraper to result in a 404 but got %d", statusCode)
+	}
+	statusCode, _ = post(t, address+"/scraper", "")
+	if statusCode != 404 {
+		t.Fatalf("expected /scraper without a scraper name to result in a 404 but got %d", statusCode)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- api.RunScrapers()
+	}()
+	for _, scraper := range api.Scrapers {
+		waitForScraperState(t, scraper.Process, scraperRunning)
+	}
+
+	// A control request can target a single scraper
+	resp, err := wsPauseScraper(api, json.RawMessage(`{"scraper":"site-a"}`))
+	checkErr(err)
+	mustEq(scraperPaused, resp.(ScraperStateResp).State)
+	mustEq(scraperRunning, api.Scrapers[1].Process.State())
+
+	_, err = wsPauseScraper(api, json.RawMessage(`{"scraper":"unknown"}`))
+	if err == nil {
+		t.Fatal("expected pausing an unknown scraper to fail")
+	}
+
+	// Without a scraper name all scrapers are controlled
+	resp, err = wsStopScraper(api, nil)
+	checkErr(err)
+	states := resp.(ScraperStateResp).Scrapers
+	mustEq(scraperStopped, states["site-a"])
+	mustEq(scraperStopped, states["site-b"])
+
+	// The client keeps running so RT-CV can start the scrapers again
+	select {
+	case <-done:
+		t.Fatal("expected RunScrapers to keep running after RT-CV stopped the scrapers")
+	case <-time.After(100 * time.Millisecond):
+	}
+	resp, err = wsRestartScraper(api, json.RawMessage(`{"scraper":"site-b"}`))
+	checkErr(err)
+	mustEq(scraperRunning, resp.(ScraperStateResp).State)
+
+	// A scraper that can't be controlled does not fail the request for the other scrapers
+	resp, err = wsPauseScraper(api, nil)
+	checkErr(err)
+	stateResp := resp.(ScraperStateResp)
+	mustEq(scraperStopped, stateResp.Scrapers["site-a"])
+	mustEq(ErrScraperNotRunning.Error(), stateResp.Errors["site-a"])
+	mustEq(scraperPaused, stateResp.Scrapers["site-b"])
+	if _, ok := stateResp.Errors["site-b"]; ok {
+		t.Fatalf("expected no error for site-b but got %+v", stateResp.Errors)
+	}
+
+	for _, scraper := range api.Scrapers {
+		checkErr(scraper.Stop(sigTerm))
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected RunScrapers to return once all scrapers exited")
+	}
+}
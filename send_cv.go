@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// cvRequest is a request to RT-CV containing one or more CVs
+// It contains everything needed to re-send the request later on, this is used by the outbox
+type cvRequest struct {
+	Path        string `json:"path"`
+	ContentType string `json:"contentType"`
+	Body        []byte `json:"body"`
+}
+
+const allCVsPath = "/api/v1/scraper/allCVs"
+
+// newAllCVsRequest creates a request for the allCVs route of RT-CV
+func newAllCVsRequest(cvs []StrippedCVWithOriginal) (cvRequest, error) {
+	body, err := json.Marshal(map[string]any{"cvs": cvs})
+	if err != nil {
+		return cvRequest{}, err
+	}
+	return cvRequest{
+		Path:        allCVsPath,
+		ContentType: "application/json",
+		Body:        body,
+	}, nil
+}
+
+// newScanCVRequest creates a request for the scanCV route of RT-CV
+func newScanCVRequest(cv []byte) cvRequest {
+	body := append(append([]byte(`{"cv":`), cv...), '}')
+	return cvRequest{
+		Path:        "/api/v1/scraper/scanCV",
+		ContentType: "application/json",
+		Body:        body,
+	}
+}
+
+// send sends the request to a connection
+// unmarshalResInto is ignored for requests that don't respond with a scanCVResponse
+func (r cvRequest) send(conn serverConn, unmarshalResInto any) error {
+	if r.Path == allCVsPath {
+		unmarshalResInto = nil
+	}
+
+	req, err := http.NewRequest("POST", conn.serverLocation+r.Path, bytes.NewReader(r.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", r.ContentType)
+
+	return conn.DoRequest(req, unmarshalResInto)
+}
+
+// scanCVResponse is the response of RT-CV to a scanned CV
+type scanCVResponse struct {
+	HasMatches bool `json:"hasMatches"`
+}
+
+// Connection delivery statuses used by ConnectionResult
+const (
+	deliveryQueued  = "queued"
+	deliverySent    = "sent"
+	deliveryFailed  = "failed"
+	deliverySkipped = "skipped"
+)
+
+// ConnectionResult is the result of sending a cv to a single RT-CV server
+type ConnectionResult struct {
+	Server  string `json:"server"`
+	Primary bool   `json:"primary"`
+	// Status is one of queued, sent, failed or skipped
+	// Queued means the cv is waiting to be sent, for example because it's in the outbox
+	// Skipped means the cv was not sent to this server because of the routing rules
+	Status     string `json:"status"`
+	HasMatches *bool  `json:"hasMatches,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// SendCVResult is the result of sending a cv to all connections
+type SendCVResult struct {
+	// HasMatch is true if the primary connection found matches for the cv
+	HasMatch    bool
+	Connections []ConnectionResult
+}
+
+// SendCVResponse is the v2 response format of the /send_cv and /send_full_cv routes
+type SendCVResponse struct {
+	// Sent is false if sending to a connection with the required delivery policy failed
+	Sent bool `json:"sent"`
+	// Cached is true if the reference number was already cached and thus the cv was not sent
+	Cached bool `json:"cached"`
+	// HasMatches is true if the primary connection found matches for the cv
+	HasMatches  bool               `json:"hasMatches"`
+	Connections []ConnectionResult `json:"connections"`
+}
+
+// SendCV sends a cv request to all connections and returns if the primary connection found matches for the CV
+// CVs that where matched to something are cached within the namespace
+//
+// The cv is sent to all connections the routing rules allow at the same time, what happens when sending to a connection fails depends on the delivery policy of the connection.
+// If a connection with the required policy fails the error of that connection is returned
+func (a *API) SendCV(namespace string, cv StrippedCV, req cvRequest) (SendCVResult, error) {
+	return a.sendCV("", namespace, cv, req)
+}
+
+// sendCV is SendCV where outboxID is used as id for the outbox item, if empty a random id is used
+func (a *API) sendCV(outboxID, namespace string, cv StrippedCV, req cvRequest) (SendCVResult, error) {
+	referenceNr := cv.ReferenceNumber
+
+	reqs := make([]*cvRequest, len(a.connections))
+	for idx, routed := range a.route(cv) {
+		if routed {
+			reqs[idx] = &req
+		}
+	}
+
+	result := SendCVResult{}
+	connections, responses, err := a.fanOut(outboxID, namespace, referenceNr, reqs)
+	result.Connections = connections
+
+	if a.primaryConnection < 0 || a.primaryConnection >= len(responses) {
+		return result, err
+	}
+	primary := responses[a.primaryConnection]
+	if primary != nil {
+		result.HasMatch = primary.HasMatches
+		if result.HasMatch {
+			// Only cache the CVs that where matched to something
+			a.SetCacheEntry(namespace, referenceNr, a.Cache.Namespace(namespace).TTL)
+		}
+	}
+
+	return result, err
+}
+
+// Delivery policies of a connection, they define what happens if sending a cv to a connection fails
+const (
+	// policyRequired makes the whole request fail
+	policyRequired = "required"
+	// policyBestEffort only reports the error in the result
+	policyBestEffort = "best_effort"
+	// policyQueue adds the request to the outbox so it's retried later on
+	policyQueue = "queue"
+)
+
+// deliveryPolicy returns the delivery policy of a connection
+// Connections without a policy use the queue policy if the outbox is enabled and otherwise the required policy
+func (a *API) deliveryPolicy(conn serverConn) string {
+	if conn.policy != "" {
+		return conn.policy
+	}
+	if a.Outbox != nil {
+		return policyQueue
+	}
+	return policyRequired
+}
+
+// fanOut sends the request of every connection at the same time and applies their delivery policy
+// reqs contains the request per connection index, connections with a nil request are skipped
+// It returns the result and response of every connection, the response is nil if sending failed
+func (a *API) fanOut(outboxID, namespace, referenceNr string, reqs []*cvRequest) ([]ConnectionResult, []*scanCVResponse, error) {
+	results := make([]ConnectionResult, len(a.connections))
+	responses := make([]*scanCVResponse, len(a.connections))
+	errs := make([]error, len(a.connections))
+
+	var wg sync.WaitGroup
+	for idx, conn := range a.connections {
+		if reqs[idx] == nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func(idx int, conn serverConn) {
+			defer wg.Done()
+
+			response := &scanCVResponse{}
+			errs[idx] = reqs[idx].send(conn, response)
+			if errs[idx] == nil {
+				responses[idx] = response
+			}
+		}(idx, conn)
+	}
+	wg.Wait()
+
+	var requiredErr error
+	// queueConnections contains the connections that need to be added to the outbox grouped by their request
+	queueConnections := map[*cvRequest][]int{}
+	for idx, conn := range a.connections {
+		results[idx] = ConnectionResult{
+			Server:  conn.serverLocation,
+			Primary: idx == a.primaryConnection,
+		}
+
+		req := reqs[idx]
+		if req == nil {
+			results[idx].Status = deliverySkipped
+			continue
+		}
+
+		err := errs[idx]
+		if err == nil {
+			results[idx].Status = deliverySent
+			if req.Path != allCVsPath {
+				results[idx].HasMatches = &responses[idx].HasMatches
+			}
+			continue
+		}
+
+		results[idx].Error = err.Error()
+		switch a.deliveryPolicy(conn) {
+		case policyQueue:
+			fmt.Printf("WARN: unable to send %s to %s, adding it to the outbox, error: %s\n", req.describe(referenceNr), conn.serverLocation, err)
+			results[idx].Status = deliveryQueued
+			queueConnections[req] = append(queueConnections[req], idx)
+		case policyBestEffort:
+			fmt.Printf("WARN: unable to send %s to %s, error: %s\n", req.describe(referenceNr), conn.serverLocation, err)
+			results[idx].Status = deliveryFailed
+		default:
+			results[idx].Status = deliveryFailed
+			if requiredErr == nil {
+				requiredErr = err
+			}
+		}
+	}
+
+	var outboxErr error
+	for req, idxs := range queueConnections {
+		var err error
+		if a.Outbox == nil {
+			err = errors.New("the outbox is disabled, set outbox_dir in env.json to enable it")
+		} else {
+			_, err = a.Outbox.Add(outboxID, namespace, referenceNr, *req, idxs)
+		}
+		if err != nil {
+			err = fmt.Errorf("unable to add %s to the outbox, error: %s", req.describe(referenceNr), err.Error())
+			for _, idx := range idxs {
+				results[idx].Status = deliveryFailed
+				results[idx].Error = err.Error()
+			}
+			if outboxErr == nil {
+				outboxErr = err
+			}
+		}
+	}
+	if outboxErr != nil {
+		return results, responses, outboxErr
+	}
+
+	return results, responses, requiredErr
+}
+
+// describe returns a short description of the request used in log messages
+func (r cvRequest) describe(referenceNr string) string {
+	if referenceNr == "" {
+		return "cvs list"
+	}
+	return "cv " + referenceNr
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSendCVDeliveryPolicies(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"hasMatches":true}`))
+	}))
+	defer primary.Close()
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+		w.Write([]byte(`{"error":"down for maintenance"}`))
+	}))
+	defer flaky.Close()
+
+	send := func(policy string) (SendCVResult, error) {
+		api := newTestAPI(t)
+		checkErr(api.SetCredentials([]SetCredentialsArg{
+			{ServerLocation: primary.URL, APIKeyID: "a", APIKey: "b", Primary: true},
+			{ServerLocation: flaky.URL, APIKeyID: "a", APIKey: "b", DeliveryPolicy: policy},
+		}))
+		return api.SendCV("", StrippedCV{ReferenceNumber: "ref"}, newScanCVRequest([]byte(`{"referenceNumber":"ref"}`)))
+	}
+
+	result, err := send(policyRequired)
+	if err == nil {
+		t.Fatal("expected an error when a required server fails")
+	}
+	if !result.HasMatch {
+		t.Fatal("expected the primary server to still receive the cv")
+	}
+
+	result, err = send(policyBestEffort)
+	checkErr(err)
+	if !result.HasMatch {
+		t.Fatal("expected the result of the primary server")
+	}
+	mustEq(deliverySent, result.Connections[0].Status)
+	mustEq(deliveryFailed, result.Connections[1].Status)
+	mustEq("down for maintenance", result.Connections[1].Error)
+
+	_, err = send(policyQueue)
+	if err == nil {
+		t.Fatal("expected an error when the queue policy is used without an outbox")
+	}
+}
+
+func TestSendCVResponseV2(t *testing.T) {
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"hasMatches":true}`))
+	}))
+	defer primary.Close()
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+		w.Write([]byte(`{"error":"down for maintenance"}`))
+	}))
+	defer flaky.Close()
+
+	api := newTestAPI(t)
+	checkErr(api.SetCredentials([]SetCredentialsArg{
+		{ServerLocation: primary.URL, APIKeyID: "a", APIKey: "b", Primary: true},
+		{ServerLocation: flaky.URL, APIKeyID: "a", APIKey: "b", DeliveryPolicy: policyBestEffort},
+	}))
+	address, server := startWebserver(Env{}, api, nil)
+	defer server.Shutdown()
+
+	sendCV := func(referenceNr string) (int, SendCVResponse) {
+		statusCode, body := post(t, address+"/send_cv?format=v2", `{"referenceNumber":"`+referenceNr+`"}`)
+		resp := SendCVResponse{}
+		err := json.Unmarshal([]byte(body), &resp)
+		if err != nil {
+			t.Fatalf("expected a v2 response but got %q", body)
+		}
+		return statusCode, resp
+	}
+
+	statusCode, resp := sendCV("a")
+	if statusCode != 200 || !resp.Sent || resp.Cached || !resp.HasMatches || len(resp.Connections) != 2 {
+		t.Fatalf("unexpected response %d %+v", statusCode, resp)
+	}
+	mustEq(primary.URL, resp.Connections[0].Server)
+	if !resp.Connections[0].Primary || resp.Connections[0].HasMatches == nil || !*resp.Connections[0].HasMatches {
+		t.Fatalf("expected the matches of the primary server, got %+v", resp.Connections[0])
+	}
+	mustEq(deliverySent, resp.Connections[0].Status)
+	mustEq(deliveryFailed, resp.Connections[1].Status)
+	mustEq("down for maintenance", resp.Connections[1].Error)
+
+	// The matched cv is cached so it's not sent again
+	statusCode, resp = sendCV("a")
+	if statusCode != 200 || resp.Sent || !resp.Cached || len(resp.Connections) != 0 {
+		t.Fatalf("expected a cached response but got %d %+v", statusCode, resp)
+	}
+
+	// If a required server fails the result is still returned
+	checkErr(api.SetCredentials([]SetCredentialsArg{
+		{ServerLocation: primary.URL, APIKeyID: "a", APIKey: "b", Primary: true},
+		{ServerLocation: flaky.URL, APIKeyID: "a", APIKey: "b", DeliveryPolicy: policyRequired},
+	}))
+	statusCode, resp = sendCV("b")
+	if statusCode != 500 || resp.Sent || !resp.HasMatches {
+		t.Fatalf("expected a failed response with the result but got %d %+v", statusCode, resp)
+	}
+	mustEq(deliveryFailed, resp.Connections[1].Status)
+}
@@ -12,7 +12,7 @@ import (
 	"github.com/valyala/fasthttp"
 )
 
-func parseSendFullCvRequest(req *fasthttp.Request) (func(conn serverConn, resp any) error, *CVMetadata, error) {
+func parseSendFullCvRequest(req *fasthttp.Request) (*cvRequest, *CVMetadata, error) {
 	// Parse the multipart form data
 	form, err := req.MultipartForm()
 	if err != nil {
@@ -60,7 +60,6 @@ func parseSendFullCvRequest(req *fasthttp.Request) (func(conn serverConn, resp a
 	creationForm := multipart.NewWriter(buff)
 
 	boundry := creationForm.Boundary()
-	defer creationForm.Close()
 
 	err = creationForm.WriteField("metadata", metadataValues[0])
 	if err != nil {
@@ -71,8 +70,15 @@ func parseSendFullCvRequest(req *fasthttp.Request) (func(conn serverConn, resp a
 		return nil, nil, err
 	}
 
-	return func(conn serverConn, resp any) error {
-		return conn.PostFormData("/api/v1/scraper/scanCVDocument", bytes.NewBuffer(buff.Bytes()), boundry, resp)
+	err = creationForm.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &cvRequest{
+		Path:        "/api/v1/scraper/scanCVDocument",
+		ContentType: "multipart/form-data; boundary=" + boundry,
+		Body:        buff.Bytes(),
 	}, &metadata, nil
 }
 
@@ -109,6 +115,17 @@ type CVMetadata struct {
 	PersonalDetails PersonalDetails `json:"personalDetails"`
 }
 
+// stripped returns the fields of the metadata that are also in StrippedCV
+func (m *CVMetadata) stripped() StrippedCV {
+	return StrippedCV{
+		ReferenceNumber: m.ReferenceNumber,
+		PersonalDetails: StrippedPersonalDetails{
+			Zip:     m.PersonalDetails.Zip,
+			Country: m.PersonalDetails.Country,
+		},
+	}
+}
+
 // PersonalDetails contains the personal details of a CV
 type PersonalDetails struct {
 	Initials          string `json:"initials,omitempty"`
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// defaultShutdownGracePeriod is the default time the scraper has to exit after receiving a SIGTERM or SIGINT
+// and the time the client has to finish its pending work afterwards
+const defaultShutdownGracePeriod = 10 * time.Second
+
+// forwardShutdownSignals forwards SIGTERM and SIGINT to the scrapers and stops their schedulers
+// If a scraper did not exit after the grace period or a second signal is received the scraper is killed
+//
+// Every scraper runs in it's own process group so without this they would never receive a Ctrl+C from a terminal
+func forwardShutdownSignals(api *API, gracePeriod time.Duration) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+
+	go func() {
+		sig := <-signals
+		fmt.Printf("received %s, stopping scrapers..\n", sig)
+		for _, scraper := range api.Scrapers {
+			err := scraper.Stop(sig.(syscall.Signal))
+			if err != nil && err != ErrScraperNotRunning {
+				fmt.Printf("WARN: unable to forward %s to %s, error: %s\n", sig, scraper.Process, err)
+			}
+		}
+
+		select {
+		case sig = <-signals:
+			fmt.Printf("received %s again, killing scrapers..\n", sig)
+		case <-time.After(gracePeriod):
+			fmt.Printf("scrapers did not exit within %s, killing scrapers..\n", gracePeriod)
+		}
+		for _, scraper := range api.Scrapers {
+			err := scraper.Process.Kill()
+			if err != nil && err != ErrScraperNotRunning {
+				fmt.Printf("WARN: unable to kill %s, error: %s\n", scraper.Process, err)
+			}
+		}
+	}()
+}
+
+// shutdown gracefully stops the client after the scrapers exited
+// The local webserver is drained, async jobs and buffered websocket responses are delivered and the websockets, cache file and log file are closed
+// All steps together take at most timeout so the client always exits in time
+func shutdown(api *API, server *fasthttp.Server, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+
+	drained := make(chan error, 1)
+	go func() {
+		drained <- server.Shutdown()
+	}()
+	select {
+	case err := <-drained:
+		if err != nil {
+			fmt.Printf("WARN: unable to shutdown the webserver, error: %s\n", err)
+		}
+	case <-time.After(time.Until(deadline)):
+		fmt.Println("WARN: webserver still has open connections, not waiting for them")
+	}
+
+	if !api.Jobs.Stop(time.Until(deadline)) {
+		fmt.Println("WARN: not all async jobs were finished, they are lost")
+	}
+
+	if !api.FlushWebsockets(time.Until(deadline)) {
+		fmt.Println("WARN: not all websocket responses could be sent to RT-CV")
+	}
+	api.CloseWebsockets()
+
+	err := api.Cache.Close()
+	if err != nil {
+		fmt.Printf("WARN: unable to close the cache file, error: %s\n", err)
+	}
+
+	if api.Logs != nil {
+		err = api.Logs.Close()
+		if err != nil {
+			fmt.Printf("WARN: unable to close the log file, error: %s\n", err)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestShutdown(t *testing.T) {
+	api := newTestAPI(t)
+	api.SetMockMode()
+	address, server := startWebserver(Env{}, api, nil)
+
+	statusCode, _, err := fasthttp.Get(nil, address+"/users")
+	checkErr(err)
+	if statusCode != 200 {
+		t.Fatalf("expected status 200 but got %d", statusCode)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		shutdown(api, server, time.Second)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected shutdown to finish within the timeout")
+	}
+
+	_, _, err = fasthttp.Get(nil, address+"/users")
+	if err == nil {
+		t.Fatal("expected the webserver to be shut down")
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reasons the watchdog kills a scraper
+const (
+	watchdogMaxRuntime = "max_runtime"
+	watchdogMaxRSS     = "max_rss"
+	watchdogNoActivity = "no_activity"
+)
+
+// defaultWatchdogInterval is how often the watchdog checks the limits of the scraper
+const defaultWatchdogInterval = 5 * time.Second
+
+// WatchdogConfig contains the limits of a scraper, a limit of 0 means no limit
+type WatchdogConfig struct {
+	// MaxRuntime is the time the scraper may run before it's killed, every restart of the scraper starts over
+	MaxRuntime time.Duration
+	// MaxRSS is the memory in bytes the scraper and all processes it started may use
+	MaxRSS int64
+	// NoActivityTimeout is the time the scraper may go without calling the local webserver before it's considered hanging
+	NoActivityTimeout time.Duration
+	// Interval is how often the limits are checked
+	Interval time.Duration
+}
+
+// WatchdogViolation describes why the watchdog killed a scraper
+type WatchdogViolation struct {
+	// Scraper is the name of the scraper, empty if the client runs the scraper command passed as arguments
+	Scraper string `json:"scraper,omitempty"`
+	// Reason is one of max_runtime, max_rss or no_activity
+	Reason  string    `json:"reason"`
+	Message string    `json:"message"`
+	At      time.Time `json:"at"`
+}
+
+// WatchdogStatus is the state of the watchdog of a scraper
+type WatchdogStatus struct {
+	// RSS is the memory in bytes used by the scraper and all processes it started when the watchdog last checked it
+	RSS           int64              `json:"rss"`
+	LastActivity  *time.Time         `json:"lastActivity"`
+	Violations    int                `json:"violations"`
+	LastViolation *WatchdogViolation `json:"lastViolation"`
+}
+
+// Watchdog kills the scraper and all processes it started if the scraper exceeds one of its limits
+// As the scraper is killed like it crashed the restart policy decides if it's started again
+type Watchdog struct {
+	scraper *ScraperProcess
+	config  WatchdogConfig
+	// onViolation is called after the scraper is killed
+	onViolation func(WatchdogViolation)
+
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	lock         sync.Mutex
+	lastActivity *time.Time
+	// idleSince is the time from which the no activity timeout is counted
+	idleSince time.Time
+	rss       int64
+	// rssUnsupported is set if the memory usage can't be read, for example because /proc is not available
+	rssUnsupported bool
+	// killedPid is the process that was killed last, it's not checked again while it's exiting
+	killedPid     int
+	violations    int
+	lastViolation *WatchdogViolation
+}
+
+// NewWatchdog creates a watchdog that checks the limits in config of scraper
+func NewWatchdog(scraper *ScraperProcess, config WatchdogConfig, onViolation func(WatchdogViolation)) *Watchdog {
+	if config.Interval <= 0 {
+		config.Interval = defaultWatchdogInterval
+	}
+
+	return &Watchdog{
+		scraper:     scraper,
+		config:      config,
+		onViolation: onViolation,
+		stop:        make(chan struct{}),
+	}
+}
+
+// Run checks the limits of the scraper until Stop is called
+func (w *Watchdog) Run() {
+	ticker := time.NewTicker(w.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case now := <-ticker.C:
+			w.check(now)
+		}
+	}
+}
+
+// Stop stops the watchdog
+func (w *Watchdog) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.stop)
+	})
+}
+
+// Touch marks the scraper as active
+func (w *Watchdog) Touch() {
+	now := time.Now()
+	w.lock.Lock()
+	w.lastActivity = &now
+	w.idleSince = now
+	w.lock.Unlock()
+}
+
+// check kills the scraper if it exceeds one of its limits at now
+func (w *Watchdog) check(now time.Time) {
+	process, startedAt, state := w.scraper.process()
+	if process == nil {
+		return
+	}
+
+	w.lock.Lock()
+	if process.Pid == w.killedPid {
+		w.lock.Unlock()
+		return
+	}
+	if w.idleSince.Before(startedAt) {
+		w.idleSince = startedAt
+	}
+	if state == scraperPaused {
+		// A paused scraper can't call the local webserver, the no activity timeout starts over once it's resumed
+		w.idleSince = now
+	}
+	idleSince := w.idleSince
+	checkRSS := w.config.MaxRSS > 0 && !w.rssUnsupported
+	w.lock.Unlock()
+
+	reason, message := "", ""
+	if w.config.MaxRuntime > 0 && now.Sub(startedAt) > w.config.MaxRuntime {
+		reason = watchdogMaxRuntime
+		message = fmt.Sprintf("%s is running for more than %s", w.scraper, w.config.MaxRuntime)
+	} else if w.config.NoActivityTimeout > 0 && now.Sub(idleSince) > w.config.NoActivityTimeout {
+		reason = watchdogNoActivity
+		message = fmt.Sprintf("%s did not call the local webserver for more than %s", w.scraper, w.config.NoActivityTimeout)
+	} else if checkRSS {
+		rss, err := processGroupRSS(process.Pid)
+		w.lock.Lock()
+		if err != nil {
+			w.rssUnsupported = true
+			fmt.Printf("WARN: unable to read the memory usage of %s, the max rss limit is ignored, error: %s\n", w.scraper, err)
+		}
+		w.rss = rss
+		w.lock.Unlock()
+		if rss > w.config.MaxRSS {
+			reason = watchdogMaxRSS
+			message = fmt.Sprintf("%s uses %d MB of memory which is more than the limit of %d MB", w.scraper, rss/1024/1024, w.config.MaxRSS/1024/1024)
+		}
+	}
+	if reason == "" {
+		return
+	}
+
+	fmt.Printf("WARN: %s, killing it..\n", message)
+	err := w.scraper.Abort()
+	if err != nil {
+		if err != ErrScraperNotRunning {
+			fmt.Printf("WARN: unable to kill %s, error: %s\n", w.scraper, err)
+		}
+		return
+	}
+
+	violation := WatchdogViolation{
+		Scraper: w.scraper.name,
+		Reason:  reason,
+		Message: message,
+		At:      now,
+	}
+	w.lock.Lock()
+	w.killedPid = process.Pid
+	w.violations++
+	w.lastViolation = &violation
+	w.lock.Unlock()
+
+	if w.onViolation != nil {
+		w.onViolation(violation)
+	}
+}
+
+// Status returns the state of the watchdog
+func (w *Watchdog) Status() WatchdogStatus {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	return WatchdogStatus{
+		RSS:           w.rss,
+		LastActivity:  w.lastActivity,
+		Violations:    w.violations,
+		LastViolation: w.lastViolation,
+	}
+}
+
+// processGroupRSS returns the resident memory in bytes of all processes in the process group pgid
+// Headless browsers start many processes so only looking at the scraper itself would miss most of the memory
+func processGroupRSS(pgid int) (int64, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0, err
+	}
+
+	var pages int64
+	for _, entry := range entries {
+		_, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		// The process might have exited in the meantime
+		stat, err := os.ReadFile("/proc/" + entry.Name() + "/stat")
+		if err != nil {
+			continue
+		}
+
+		// The fields come after the command name which is wrapped in parentheses and can contain spaces
+		// See proc(5), the process group is the 5th field and the rss in pages the 24th
+		end := strings.LastIndexByte(string(stat), ')')
+		if end < 0 {
+			continue
+		}
+		fields := strings.Fields(string(stat[end+1:]))
+		if len(fields) < 22 || fields[2] != strconv.Itoa(pgid) {
+			continue
+		}
+		rss, err := strconv.ParseInt(fields[21], 10, 64)
+		if err == nil {
+			pages += rss
+		}
+	}
+	return pages * int64(os.Getpagesize()), nil
+}
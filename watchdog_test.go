@@ -0,0 +1,128 @@
+package main
+
+import (
+	"os"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestWatchdogNoActivity(t *testing.T) {
+	p := NewScraperProcess("", []string{"sleep", "10"}, os.Environ())
+	violations := make(chan WatchdogViolation, 1)
+	w := NewWatchdog(p, WatchdogConfig{NoActivityTimeout: time.Minute}, func(violation WatchdogViolation) {
+		violations <- violation
+	})
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- p.Run()
+	}()
+	waitForScraperState(t, p, scraperRunning)
+	defer p.Kill()
+
+	// Activity of the scraper postpones the timeout
+	w.Touch()
+	w.check(time.Now().Add(30 * time.Second))
+	mustEq(scraperRunning, p.State())
+
+	// A paused scraper can't be active so the timeout starts over
+	checkErr(p.Pause())
+	w.check(time.Now().Add(2 * time.Minute))
+	checkErr(p.Resume())
+	w.check(time.Now().Add(2*time.Minute + 30*time.Second))
+	mustEq(scraperRunning, p.State())
+
+	w.check(time.Now().Add(4 * time.Minute))
+	select {
+	case err := <-exited:
+		code, _ := exitCode(err)
+		mustEq("137", strconv.Itoa(code))
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the scraper to be killed")
+	}
+	mustEq(scraperExited, p.State())
+
+	violation := <-violations
+	mustEq(watchdogNoActivity, violation.Reason)
+	status := w.Status()
+	if status.Violations != 1 || status.LastViolation == nil || status.LastActivity == nil {
+		t.Fatalf("expected 1 violation and the last activity to be set but got %+v", status)
+	}
+}
+
+func TestWatchdogMaxRuntimeRestarts(t *testing.T) {
+	p := NewScraperProcess("", []string{"sleep", "10"}, os.Environ())
+	p.SetRestartPolicy(RestartPolicy{Policy: restartOnFailure, MaxRestarts: 1, Backoff: time.Millisecond})
+	w := NewWatchdog(p, WatchdogConfig{MaxRuntime: time.Minute}, nil)
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- p.Run()
+	}()
+	waitForScraperState(t, p, scraperRunning)
+	defer p.Kill()
+	pid := p.cmd.Process.Pid
+
+	w.check(time.Now().Add(30 * time.Second))
+	mustEq(scraperRunning, p.State())
+
+	// The scraper is killed as if it crashed so the restart policy starts it again
+	w.check(time.Now().Add(2 * time.Minute))
+	for i := 0; i < 500; i++ {
+		process, _, _ := p.process()
+		if process != nil && process.Pid != pid {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mustEq(scraperRunning, p.State())
+	if p.Status().Restarts != 1 {
+		t.Fatal("expected the scraper to be restarted")
+	}
+
+	// The runtime of the new process starts over
+	w.check(time.Now().Add(30 * time.Second))
+	mustEq(scraperRunning, p.State())
+
+	w.check(time.Now().Add(2 * time.Minute))
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the scraper to be killed")
+	}
+	mustEq(watchdogMaxRuntime, w.Status().LastViolation.Reason)
+	mustEq("2", strconv.Itoa(w.Status().Violations))
+}
+
+func TestWatchdogMaxRSS(t *testing.T) {
+	if _, err := os.Stat("/proc/self/stat"); err != nil {
+		t.Skip("/proc is not available")
+	}
+
+	// The shell starts a child process so the memory of the whole process group is counted
+	p := NewScraperProcess("", []string{"sh", "-c", "sleep 10; true"}, os.Environ())
+	w := NewWatchdog(p, WatchdogConfig{MaxRSS: 1024 * 1024 * 1024}, nil)
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- p.Run()
+	}()
+	waitForScraperState(t, p, scraperRunning)
+	defer p.Kill()
+
+	w.check(time.Now())
+	mustEq(scraperRunning, p.State())
+	if w.Status().RSS <= 0 {
+		t.Fatalf("expected the rss to be measured but got %d", w.Status().RSS)
+	}
+
+	w.config.MaxRSS = 1
+	w.check(time.Now())
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the scraper to be killed")
+	}
+	mustEq(watchdogMaxRSS, w.Status().LastViolation.Reason)
+}
@@ -1,18 +1,28 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"log"
 	"net"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/valyala/fasthttp"
 )
 
-func startWebserver(env Env, api *API, loginUsers []EnvUser) string {
+// startWebserver starts the local webserver used by the scraper
+// Returns the address of the webserver and the server itself so it can be shut down
+func startWebserver(env Env, api *API, loginUsers []EnvUser) (string, *fasthttp.Server) {
+	address, listener := listenWebserver()
+	return address, serveWebserver(env, api, loginUsers, listener)
+}
+
+// serveWebserver serves the local webserver on listener in the background
+// The scrapers of api should be set before calling this as the request handler reads them without locking
+func serveWebserver(env Env, api *API, loginUsers []EnvUser, listener net.Listener) *fasthttp.Server {
 	loginUsersJSON, err := json.Marshal(loginUsers)
 	if err != nil {
 		log.Fatal(err)
@@ -24,6 +34,30 @@ func startWebserver(env Env, api *API, loginUsers []EnvUser) string {
 			return ctx.Request.Body()
 		}
 
+		// Requests of a named scraper are prefixed with /scrapers/{name}
+		scraper := api.onlyScraper()
+		if strings.HasPrefix(path, scraperPathPrefix("")) {
+			name, rest, _ := strings.Cut(strings.TrimPrefix(path, scraperPathPrefix("")), "/")
+			scraper = api.findScraper(name)
+			if name == "" || scraper == nil {
+				errorResp(ctx, 404, "unknown scraper "+name)
+				return
+			}
+			path = "/" + rest
+		}
+		defaultNamespace := ""
+		if scraper != nil {
+			defaultNamespace = scraper.CacheNamespace
+		}
+		namespace := cacheNamespace(ctx, defaultNamespace)
+
+		switch path {
+		case "/websockets", "/scrapers", "/logs", "/scraper", "/schedule":
+			// These routes are usually called by monitoring instead of the scraper so they don't count as activity for the watchdog
+		default:
+			api.scraperActivity(scraper)
+		}
+
 		switch path {
 		case "/send_cv":
 			cvForChecking := StrippedCV{}
@@ -39,75 +73,30 @@ func startWebserver(env Env, api *API, loginUsers []EnvUser) string {
 				return
 			}
 
-			cacheEntryExists := api.CacheEntryExists(cvForChecking.ReferenceNumber)
+			cacheEntryExists := api.CacheEntryExists(namespace, cvForChecking.ReferenceNumber)
 			if cacheEntryExists {
 				// Cannot send the same cv twice
+				if responseFormatV2(ctx) {
+					jsonResp(ctx, SendCVResponse{Cached: true, Connections: []ConnectionResult{}})
+					break
+				}
 				ctx.Response.AppendBodyString("false")
 				return
 			}
 
-			hasMatch := false
-			if api.MockMode {
-				api.SetCacheEntry(cvForChecking.ReferenceNumber, time.Hour*72)
-				hasMatch = true
-			} else {
-				scanCVBody := json.RawMessage(append(append([]byte(`{"cv":`), body()...), '}'))
-
-				for idx, conn := range api.connections {
-					var response struct {
-						HasMatches bool `json:"hasMatches"`
-					}
-
-					err = conn.Post("/api/v1/scraper/scanCV", scanCVBody, &response)
-					if err != nil {
-						errorResp(ctx, 500, err.Error())
-						return
-					}
-
-					if idx == api.primaryConnection {
-						hasMatch = response.HasMatches
-						if hasMatch {
-							// Only cache the CVs that where matched to something
-							api.SetCacheEntry(cvForChecking.ReferenceNumber, time.Hour*72) // 3 days
-						}
-					}
-				}
+			if !sendCVResp(ctx, api, namespace, cvForChecking, newScanCVRequest(body())) {
+				return
 			}
-
-			ctx.Response.AppendBodyString("true")
 		case "/send_full_cv":
-			send, cv, err := parseSendFullCvRequest(&ctx.Request)
+			req, cv, err := parseSendFullCvRequest(&ctx.Request)
 			if err != nil {
 				errorResp(ctx, 400, err.Error())
 				return
 			}
 
-			hasMatch := false
-			if api.MockMode {
-				api.SetCacheEntry(cv.ReferenceNumber, time.Hour*72)
-				hasMatch = true
-			} else {
-				for idx, conn := range api.connections {
-					var response struct {
-						HasMatches bool `json:"hasMatches"`
-					}
-
-					err = send(conn, &response)
-					if err != nil {
-						errorResp(ctx, 500, err.Error())
-						return
-					}
-
-					if idx == api.primaryConnection {
-						hasMatch = response.HasMatches
-						if hasMatch {
-							// Only cache the CVs that where matched to something
-							api.SetCacheEntry(cv.ReferenceNumber, time.Hour*72) // 3 days
-						}
-					}
-				}
+			if !sendCVResp(ctx, api, namespace, cv.stripped(), *req) {
+				return
 			}
-			ctx.Response.AppendBodyString("true")
 		case "/cvs_list":
 			cvs := []StrippedCVWithOriginal{}
 			err := json.Unmarshal(body(), &cvs)
@@ -117,7 +106,7 @@ func startWebserver(env Env, api *API, loginUsers []EnvUser) string {
 			}
 
 			checkedRefNrs := map[string]struct{}{}
-			for idx := 10; idx >= 0; idx-- {
+			for idx := len(cvs) - 1; idx >= 0; idx-- {
 				cv := cvs[idx]
 				err := cv.checkRefNr()
 				if err != nil {
@@ -140,18 +129,49 @@ func startWebserver(env Env, api *API, loginUsers []EnvUser) string {
 				}
 			}
 
-			if !api.MockMode {
-				for _, conn := range api.connections {
-					err = conn.Post("/api/v1/scraper/allCVs", map[string]any{"cvs": cvs}, nil)
-					if err != nil {
-						errorResp(ctx, 500, err.Error())
-						return
-					}
+			if api.MockMode {
+				if responseFormatV2(ctx) {
+					jsonResp(ctx, SendCVResponse{Sent: true, Connections: []ConnectionResult{}})
+				} else {
+					ctx.Response.AppendBodyString("true")
+				}
+				break
+			}
+
+			reqs, err := api.cvsListRequests(cvs)
+			if err != nil {
+				errorResp(ctx, 500, err.Error())
+				return
+			}
+
+			results, _, err := api.fanOut("", "", "", reqs)
+			if responseFormatV2(ctx) {
+				if err != nil {
+					ctx.Response.SetStatusCode(500)
 				}
+				jsonResp(ctx, SendCVResponse{Sent: err == nil, Connections: results})
+				break
+			}
+			if err != nil {
+				errorResp(ctx, 500, err.Error())
+				return
 			}
 
 			ctx.Response.AppendBodyString("true")
+		case "/route_cv":
+			cv := StrippedCV{}
+			err := json.Unmarshal(body(), &cv)
+			if err != nil {
+				errorResp(ctx, 400, "invalid CV")
+				return
+			}
+
+			jsonResp(ctx, api.routedServers(cv))
 		case "/users":
+			if scraper != nil && scraper.Users != nil {
+				jsonResp(ctx, scraper.Users)
+				break
+			}
 			ctx.Response.AppendBody(loginUsersJSON)
 		case "/set_cached_reference", "/set_short_cached_reference":
 			refNr := string(ctx.Request.Body())
@@ -160,10 +180,11 @@ func startWebserver(env Env, api *API, loginUsers []EnvUser) string {
 				return
 			}
 
+			cache := api.Cache.Namespace(namespace)
 			if path == "/set_cached_reference" {
-				api.SetCacheEntry(refNr, time.Hour*72) // 3 days
+				api.SetCacheEntry(namespace, refNr, cache.TTL)
 			} else {
-				api.SetCacheEntry(refNr, time.Hour*12) // 0.5 days
+				api.SetCacheEntry(namespace, refNr, cache.ShortTTL)
 			}
 
 			ctx.Response.AppendBodyString("true")
@@ -174,17 +195,118 @@ func startWebserver(env Env, api *API, loginUsers []EnvUser) string {
 				return
 			}
 
-			if api.CacheEntryExists(refNr) {
+			if api.CacheEntryExists(namespace, refNr) {
 				ctx.Response.AppendBodyString("true")
 			} else {
 				ctx.Response.AppendBodyString("false")
 			}
+		case "/set_cached_references":
+			entries, err := parseSetCachedReferencesBody(body(), api.Cache.Namespace(namespace).TTL)
+			if err != nil {
+				errorResp(ctx, 400, err.Error())
+				return
+			}
+
+			for refNr, expires := range entries {
+				api.SetCacheEntryExpires(namespace, refNr, expires)
+			}
+
+			ctx.Response.AppendBodyString("true")
+		case "/get_cached_references":
+			refNrs, err := parseGetCachedReferencesBody(body())
+			if err != nil {
+				errorResp(ctx, 400, err.Error())
+				return
+			}
+
+			resp := make(map[string]bool, len(refNrs))
+			for _, refNr := range refNrs {
+				resp[refNr] = api.CacheEntryExists(namespace, refNr)
+			}
+			jsonResp(ctx, resp)
+		case "/delete_cached_reference":
+			refNr := string(ctx.Request.Body())
+			if refNr == "" {
+				errorResp(ctx, 400, "reference number cannot be an empty string")
+				return
+			}
+
+			if api.DeleteCacheEntry(namespace, refNr) {
+				ctx.Response.AppendBodyString("true")
+			} else {
+				ctx.Response.AppendBodyString("false")
+			}
+		case "/cached_references":
+			jsonResp(ctx, api.Cache.Lookup(namespace).Entries())
+		case "/cache_stats":
+			jsonResp(ctx, api.Cache.Lookup(namespace).Stats())
+		case "/cache_namespaces":
+			jsonResp(ctx, api.Cache.Stats())
+		case "/export_cached_references":
+			err := api.Cache.Lookup(namespace).Export(ctx)
+			if err != nil {
+				errorResp(ctx, 500, err.Error())
+				return
+			}
+			ctx.Response.Header.Set("Content-Type", "application/x-ndjson")
+			return
+		case "/import_cached_references":
+			imported, err := api.ImportCacheEntries(namespace, bytes.NewReader(ctx.Request.Body()))
+			if err != nil {
+				errorResp(ctx, 400, err.Error())
+				return
+			}
+			ctx.Response.AppendBodyString(strconv.Itoa(imported))
+		case "/outbox":
+			if api.Outbox == nil {
+				errorResp(ctx, 400, "the outbox is disabled, set outbox_dir in env.json to enable it")
+				return
+			}
+			jsonResp(ctx, api.Outbox.Status(ctx.QueryArgs().Has("failed")))
+		case "/outbox_redrive":
+			if api.Outbox == nil {
+				errorResp(ctx, 400, "the outbox is disabled, set outbox_dir in env.json to enable it")
+				return
+			}
+			redriven, err := api.Outbox.Redrive(string(body()))
+			if err != nil {
+				errorResp(ctx, 400, err.Error())
+				return
+			}
+			ctx.Response.AppendBodyString(strconv.Itoa(redriven))
+		case "/jobs":
+			ids := []string{}
+			err := json.Unmarshal(body(), &ids)
+			if err != nil {
+				errorResp(ctx, 400, "invalid body, expected an array of job ids")
+				return
+			}
+
+			resp := make(map[string]*Job, len(ids))
+			for _, id := range ids {
+				job, _ := api.Jobs.Get(id)
+				resp[id] = job
+			}
+			jsonResp(ctx, resp)
 		case "/server_response":
 			if api.MockMode {
 				ctx.Response.AppendBodyString("false")
+				break
 			}
 
-			api.HandleWebsocketResponse(ctx.Request.Body())
+			written, err := api.HandleWebsocketResponse(ctx.Request.Body())
+			if err != nil {
+				errorResp(ctx, 400, err.Error())
+				return
+			}
+			if ctx.QueryArgs().Has("wait") {
+				// Wait until the response is written to the websocket of RT-CV
+				err = <-written
+				if err != nil {
+					errorResp(ctx, 500, err.Error())
+					return
+				}
+			}
 			ctx.Response.AppendBodyString("true")
 		case "/server_request":
 			// Cancel previous calls to this endpoint
@@ -192,13 +314,79 @@ func startWebserver(env Env, api *API, loginUsers []EnvUser) string {
 			// This is a bit of a dirty hack but it works we just cancel all previous calls to this endpoint when a new one is made
 			api.CancelPreviouseCommunication()
 
-			select {
-			case <-api.CancelPreviouseCommunicationChan:
+			req, ok := api.WSRequests.next(api.CancelPreviouseCommunicationChan)
+			if !ok {
 				errorResp(ctx, 400, "a new request has been opened")
-			case req := <-api.WebsocketReq:
-				ctx.Response.AppendBody(req)
+				return
+			}
+			ctx.Response.AppendBody(req)
+		case "/server_requests/stream":
+			lastEventIDHeader := ctx.Request.Header.Peek("Last-Event-ID")
+			lastEventID, err := strconv.ParseUint(string(lastEventIDHeader), 10, 64)
+			resume := err == nil
+			if len(lastEventIDHeader) > 0 && !resume {
+				errorResp(ctx, 400, "invalid Last-Event-ID header, expected a number")
+				return
+			}
+
+			ctx.Response.Header.Set("Content-Type", "text/event-stream")
+			ctx.Response.Header.Set("Cache-Control", "no-cache")
+			ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+				api.WSRequests.stream(w, lastEventID, resume)
+			})
+			return
+		case "/websockets":
+			jsonResp(ctx, api.WebsocketStates())
+		case "/scrapers":
+			jsonResp(ctx, api.ScraperStatuses())
+		case "/logs":
+			if api.Logs == nil {
+				errorResp(ctx, 404, "the output of the scrapers is not captured")
+				return
+			}
+			lines := 100
+			if ctx.QueryArgs().Has("lines") {
+				var err error
+				lines, err = ctx.QueryArgs().GetUint("lines")
+				if err != nil || lines == 0 {
+					errorResp(ctx, 400, "lines must be a positive number")
+					return
+				}
+			}
+			filter := LogFilter{Source: string(ctx.QueryArgs().Peek("source"))}
+			if ctx.QueryArgs().Has("scraper") {
+				name := string(ctx.QueryArgs().Peek("scraper"))
+				filter.Scraper = &name
+			} else if scraper != nil && scraper.Name != "" {
+				filter.Scraper = &scraper.Name
+			}
+			jsonResp(ctx, api.Logs.Tail(lines, filter))
+		case "/scraper":
+			if scraper == nil {
+				errorResp(ctx, 404, "unknown scraper, use /scrapers/{name}/scraper if multiple scrapers are configured")
+				return
 			}
+			jsonResp(ctx, scraper.Status())
+		case "/schedule":
+			if scraper == nil || scraper.Scheduler == nil {
+				errorResp(ctx, 404, "the scraper does not run on a schedule")
+				return
+			}
+			jsonResp(ctx, scraper.Scheduler.Status())
+		case "/server_requests/ws":
+			serveLocalWebsocket(ctx, api, scraper)
+			return
 		default:
+			if strings.HasPrefix(path, "/jobs/") {
+				job, ok := api.Jobs.Get(strings.TrimPrefix(path, "/jobs/"))
+				if !ok {
+					errorResp(ctx, 404, "job not found")
+					return
+				}
+				jsonResp(ctx, job)
+				break
+			}
+
 			errorResp(ctx, 404, "404 not found")
 			return
 		}
@@ -206,7 +394,18 @@ func startWebserver(env Env, api *API, loginUsers []EnvUser) string {
 	}
 
 	s := &fasthttp.Server{Handler: requestHandler}
+	go func() {
+		err := s.Serve(listener)
+		if err != nil {
+			log.Fatal("Error in Serve: " + err.Error())
+		}
+	}()
+	return s
+}
 
+// listenWebserver listens on the first free port from 4001 for the local webserver
+// Returns the address of the webserver and the listener
+func listenWebserver() (string, net.Listener) {
 	portAttempt := 4_000
 	for {
 		portAttempt++
@@ -226,18 +425,104 @@ func startWebserver(env Env, api *API, loginUsers []EnvUser) string {
 			log.Fatal("Error in Listen: " + err.Error())
 		}
 
-		go func() {
-			err = s.Serve(l)
-			if err != nil {
-				log.Fatal("Error in Serve: " + err.Error())
-			}
-		}()
+		return "http://" + address, l
+	}
+}
 
-		return "http://" + address
+// sendCVResp sends a cv to RT-CV and writes the response of the /send_cv and /send_full_cv routes
+// If the async query parameter is set the cv is send in the background and the created job is returned
+// Returns false if an error response was written
+func sendCVResp(ctx *fasthttp.RequestCtx, api *API, namespace string, cv StrippedCV, req cvRequest) bool {
+	referenceNr := cv.ReferenceNumber
+	async := ctx.QueryArgs().Has("async")
+	v2 := responseFormatV2(ctx)
+
+	if api.MockMode {
+		api.SetCacheEntry(namespace, referenceNr, api.Cache.Namespace(namespace).TTL)
+		if v2 && !async {
+			jsonResp(ctx, SendCVResponse{Sent: true, HasMatches: true, Connections: []ConnectionResult{}})
+			return true
+		}
+		if !async {
+			ctx.Response.AppendBodyString("true")
+			return true
+		}
+
+		job, err := api.Jobs.AddDone(namespace, referenceNr, true)
+		if err != nil {
+			errorResp(ctx, 500, err.Error())
+			return false
+		}
+		jsonResp(ctx, job)
+		return true
+	}
+
+	if async {
+		job, err := api.Jobs.Add(namespace, cv, req)
+		if err == ErrJobQueueFull || err == ErrJobsStopped {
+			errorResp(ctx, 503, err.Error())
+			return false
+		} else if err != nil {
+			errorResp(ctx, 500, err.Error())
+			return false
+		}
+		jsonResp(ctx, job)
+		return true
 	}
+
+	result, err := api.SendCV(namespace, cv, req)
+	if v2 {
+		if err != nil {
+			// We still respond with the result so the scraper knows which connections failed
+			ctx.Response.SetStatusCode(500)
+		}
+		jsonResp(ctx, SendCVResponse{
+			Sent:        err == nil,
+			HasMatches:  result.HasMatch,
+			Connections: result.Connections,
+		})
+		return true
+	}
+
+	if err != nil {
+		errorResp(ctx, 500, err.Error())
+		return false
+	}
+	ctx.Response.AppendBodyString("true")
+	return true
+}
+
+// responseFormatV2 returns true if the v2 response format is requested using the format=v2 query parameter
+func responseFormatV2(ctx *fasthttp.RequestCtx) bool {
+	return string(ctx.QueryArgs().Peek("format")) == "v2"
+}
+
+// cacheNamespace returns the cache namespace of a request
+// The namespace can be set using the X-Cache-Namespace header or the namespace query parameter, if not set defaultNamespace is used
+func cacheNamespace(ctx *fasthttp.RequestCtx, defaultNamespace string) string {
+	namespace := string(ctx.Request.Header.Peek("X-Cache-Namespace"))
+	if namespace == "" {
+		namespace = string(ctx.QueryArgs().Peek("namespace"))
+	}
+	if namespace == "" {
+		namespace = defaultNamespace
+	}
+	if namespace == "" {
+		return defaultCacheNamespace
+	}
+	return namespace
 }
 
 func errorResp(ctx *fasthttp.RequestCtx, code int, msg string) {
 	ctx.Response.AppendBodyString(msg)
 	ctx.Response.SetStatusCode(code)
 }
+
+func jsonResp(ctx *fasthttp.RequestCtx, value any) {
+	resp, err := json.Marshal(value)
+	if err != nil {
+		errorResp(ctx, 500, err.Error())
+		return
+	}
+	ctx.Response.AppendBody(resp)
+}
@@ -0,0 +1,582 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WSMsg is a message recived and send to the websocket
+type WSMsg[T any] struct {
+	Type string `json:"type"`
+	ID   string `json:"id,omitempty"`
+	Data T      `json:"data"`
+	// Error is set if the request could not be handled
+	Error string `json:"error,omitempty"`
+}
+
+// wsSession is the websocket connection with a single RT-CV server
+// Every connection has it's own session so servers connect and reconnect independently of each other
+type wsSession struct {
+	api    *API
+	idx    int
+	server serverConn
+
+	// wake is signaled when there are new responses to write or the connection was re-established
+	wake   chan struct{}
+	closed chan struct{}
+
+	lock sync.Mutex
+	// conn is nil while the session is (re)connecting
+	conn *websocket.Conn
+	// reconnects is the amount of times the connection was lost and re-established
+	reconnects int
+	// outbound contains the responses that still need to be written to the websocket, oldest first
+	outbound []*wsOutboundMsg
+	config   wsSessionConfig
+
+	state      string
+	stateSince time.Time
+	lastError  string
+}
+
+// Websocket connection states
+const (
+	wsConnecting   = "connecting"
+	wsConnected    = "connected"
+	wsDisconnected = "disconnected"
+	wsClosed       = "closed"
+)
+
+// WebsocketState is the state of the websocket connection with a RT-CV server
+type WebsocketState struct {
+	Server     string    `json:"server"`
+	State      string    `json:"state"`
+	Since      time.Time `json:"since"`
+	Reconnects int       `json:"reconnects"`
+	// LastError is the reason the connection was lost or could not be made
+	LastError         string `json:"lastError,omitempty"`
+	BufferedResponses int    `json:"bufferedResponses"`
+}
+
+// wsSessionConfig contains the settings of the websocket sessions, zero values are replaced by the defaults
+type wsSessionConfig struct {
+	// responseMaxAge is the time a response is kept in the outbound buffer before it's dropped
+	responseMaxAge time.Duration
+	// pingInterval is the time between the keep alive pings
+	pingInterval time.Duration
+	// pongWait is the time we wait for a pong or another message before the connection is considered dead
+	pongWait time.Duration
+	// writeWait is the time a single write may take before the connection is considered dead
+	writeWait time.Duration
+}
+
+func (c wsSessionConfig) withDefaults() wsSessionConfig {
+	if c.responseMaxAge <= 0 {
+		c.responseMaxAge = wsResponseMaxAge
+	}
+	if c.pingInterval <= 0 {
+		// There is at least one proxy service in our cluster that closes the connection after 30 seconds of inactivity
+		// So we need to send something more often than that
+		c.pingInterval = time.Second * 20
+	}
+	if c.pongWait <= 0 {
+		c.pongWait = c.pingInterval*2 + time.Second*5
+	}
+	if c.writeWait <= 0 {
+		c.writeWait = time.Second * 10
+	}
+	return c
+}
+
+// wsOutboundMsg is a response waiting to be written to the websocket
+type wsOutboundMsg struct {
+	// id is the message id as RT-CV knows it
+	id       string
+	payload  []byte
+	queuedAt time.Time
+	attempts int
+	// written receives nil once the response is written or an error if the response is dropped
+	written chan error
+}
+
+// wsResponseMaxAge is the default time a response is kept while the websocket is not connected
+const wsResponseMaxAge = time.Minute * 5
+
+// wsMaxReconnectBackoff is the max time between two connection attempts
+const wsMaxReconnectBackoff = time.Second * 30
+
+var (
+	wsJitterLock sync.Mutex
+	wsJitter     = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+func newWSSession(api *API, idx int) *wsSession {
+	return &wsSession{
+		api:        api,
+		idx:        idx,
+		server:     api.connections[idx],
+		wake:       make(chan struct{}, 1),
+		closed:     make(chan struct{}),
+		config:     api.wsConfig.withDefaults(),
+		state:      wsConnecting,
+		stateSince: time.Now(),
+	}
+}
+
+func (s *wsSession) url() string {
+	url := s.server.serverLocation
+	url = strings.Replace(url, "http://", "ws://", 1)
+	url = strings.Replace(url, "https://", "wss://", 1)
+	return url + "/api/v1/scraper/ws"
+}
+
+func (s *wsSession) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// close stops the session and closes the websocket
+func (s *wsSession) close() {
+	s.lock.Lock()
+	if s.isClosed() {
+		s.lock.Unlock()
+		return
+	}
+	close(s.closed)
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	s.lock.Unlock()
+
+	s.setState(wsClosed, nil)
+}
+
+// setState changes the connection state and notifies the scraper of the change
+func (s *wsSession) setState(state string, err error) {
+	s.lock.Lock()
+	if s.state == wsClosed {
+		s.lock.Unlock()
+		return
+	}
+	changed := s.state != state
+	if changed {
+		s.state = state
+		s.stateSince = time.Now()
+	}
+	if err != nil {
+		s.lastError = err.Error()
+	}
+	s.lock.Unlock()
+
+	if changed {
+		s.api.WSRequests.pushEvent(wsConnectionStateEvent, s.State())
+	}
+}
+
+// State returns the current state of the connection
+func (s *wsSession) State() WebsocketState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return WebsocketState{
+		Server:            s.server.serverLocation,
+		State:             s.state,
+		Since:             s.stateSince,
+		Reconnects:        s.reconnects,
+		LastError:         s.lastError,
+		BufferedResponses: len(s.outbound),
+	}
+}
+
+// wsReconnectBackoff returns the time to wait before the next connection attempt
+// The backoff grows exponentially and is jittered so not all scrapers reconnect at the same time after a RT-CV restart
+func wsReconnectBackoff(attempt int) time.Duration {
+	backoff := time.Second
+	for i := 1; i < attempt && backoff < wsMaxReconnectBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > wsMaxReconnectBackoff {
+		backoff = wsMaxReconnectBackoff
+	}
+
+	// Wait between half and the full backoff
+	wsJitterLock.Lock()
+	jitter := time.Duration(wsJitter.Int63n(int64(backoff/2) + 1))
+	wsJitterLock.Unlock()
+	return backoff/2 + jitter
+}
+
+// dial connects to the websocket of the server, retrying until it succeeds or the session is closed
+func (s *wsSession) dial() *websocket.Conn {
+	url := s.url()
+
+	attempt := 0
+	for {
+		conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Authorization": []string{s.server.authHeaderValue}})
+		if err == nil {
+			if attempt > 0 {
+				fmt.Println("connected to web socket of", s.server.serverLocation)
+			}
+			return conn
+		}
+
+		attempt++
+		s.setState(wsConnecting, err)
+		retryIn := wsReconnectBackoff(attempt)
+
+		fmt.Printf("unable to connect to web socket of %s, error: %s, retrying in %s\n", s.server.serverLocation, err, retryIn.Round(time.Millisecond))
+		select {
+		case <-time.After(retryIn):
+		case <-s.closed:
+			return nil
+		}
+	}
+}
+
+// ping writes a keep alive ping to the current connection
+func (s *wsSession) ping(data []byte) error {
+	s.lock.Lock()
+	conn := s.conn
+	s.lock.Unlock()
+
+	if conn == nil {
+		return errors.New("not connected")
+	}
+	return conn.WriteControl(websocket.PingMessage, data, time.Now().Add(s.config.writeWait))
+}
+
+func (s *wsSession) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// enqueue adds a response to the outbound buffer of the session
+func (s *wsSession) enqueue(id string, payload []byte) <-chan error {
+	msg := &wsOutboundMsg{
+		id:       id,
+		payload:  payload,
+		queuedAt: time.Now(),
+		written:  make(chan error, 1),
+	}
+
+	s.lock.Lock()
+	s.outbound = append(s.outbound, msg)
+	s.lock.Unlock()
+
+	s.notify()
+	return msg.written
+}
+
+// flush writes the buffered responses until the buffer is empty or a write fails
+// Responses that are older than the max age are dropped
+//
+// Only the writer goroutine writes to the connection and removes responses from the buffer,
+// so the lock is released while writing and a slow or half-open connection does not block the other users of the session
+func (s *wsSession) flush() {
+	for {
+		s.lock.Lock()
+		maxAge := s.config.responseMaxAge
+		if len(s.outbound) == 0 || s.conn == nil && time.Since(s.outbound[0].queuedAt) <= maxAge {
+			s.lock.Unlock()
+			return
+		}
+
+		msg := s.outbound[0]
+		if time.Since(msg.queuedAt) > maxAge {
+			s.outbound = s.outbound[1:]
+			s.lock.Unlock()
+
+			err := fmt.Errorf("dropped websocket response %s to %s after %d failed attempts as it's older than %s", msg.id, s.server.serverLocation, msg.attempts, maxAge)
+			fmt.Println("WARN:", err)
+			msg.written <- err
+			continue
+		}
+
+		conn := s.conn
+		msg.attempts++
+		s.lock.Unlock()
+
+		conn.SetWriteDeadline(time.Now().Add(s.config.writeWait))
+		err := conn.WriteMessage(websocket.TextMessage, msg.payload)
+		if err != nil {
+			// The connection is broken, closing it makes the reader re-connect after which the response is retried
+			conn.Close()
+			fmt.Printf("unable to write ws response %s to %s, retrying after reconnect: %s\n", msg.id, s.server.serverLocation, err)
+			return
+		}
+
+		s.lock.Lock()
+		s.outbound = s.outbound[1:]
+		s.lock.Unlock()
+
+		fmt.Printf("sent ws response %s to %s\n", msg.id, s.server.serverLocation)
+		msg.written <- nil
+	}
+}
+
+// writer writes the buffered responses and keep alive messages to the websocket
+func (s *wsSession) writer() {
+	// Send keep alive messages so proxies don't close the connection because of inactivity
+	// RT-CV answers the ping with a pong which is used to detect dead connections, see run
+	keepAliveTicker := time.NewTicker(s.config.pingInterval)
+	defer keepAliveTicker.Stop()
+	keepAliveBody := []byte("pnig")
+
+	// Makes sure responses are dropped when they reach the max age even if the connection is never re-established
+	retryTicker := time.NewTicker(time.Second)
+	defer retryTicker.Stop()
+
+	for {
+		s.flush()
+
+		select {
+		case <-keepAliveTicker.C:
+			s.ping(keepAliveBody)
+		case <-s.wake:
+		case <-retryTicker.C:
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// run connects to the websocket and reads the messages from it until the session is closed
+func (s *wsSession) run() {
+	go s.writer()
+
+	for connected := false; ; connected = true {
+		c := s.dial()
+		if c == nil {
+			return
+		}
+
+		s.lock.Lock()
+		if s.isClosed() {
+			s.lock.Unlock()
+			c.Close()
+			return
+		}
+		s.conn = c
+		if connected {
+			s.reconnects++
+		}
+		s.lock.Unlock()
+		s.setState(wsConnected, nil)
+		s.notify()
+
+		// If we do not receive a pong or another message in time the connection is probably half-open
+		// The read will fail once the deadline is reached after which we reconnect
+		pongWait := s.config.pongWait
+		c.SetReadDeadline(time.Now().Add(pongWait))
+		c.SetPongHandler(func(string) error {
+			return c.SetReadDeadline(time.Now().Add(pongWait))
+		})
+
+		for {
+			msgType, msgBytes, err := c.ReadMessage()
+			if err != nil {
+				if !s.isClosed() {
+					fmt.Printf("error reading from web socket of %s: %s\n", s.server.serverLocation, err)
+					s.setState(wsDisconnected, err)
+				}
+				break
+			}
+			c.SetReadDeadline(time.Now().Add(pongWait))
+
+			switch msgType {
+			case websocket.TextMessage, websocket.BinaryMessage:
+				// Ok continue
+			default:
+				// Ignore other message types
+				continue
+			}
+
+			msg := WSMsg[json.RawMessage]{}
+			err = json.Unmarshal(msgBytes, &msg)
+			if err != nil {
+				fmt.Println("error un-marshaling web socket message:", err)
+				continue
+			}
+
+			// We inject the index of the server connection into the message id so we know where to send the response to later
+			// See the /server_response for how we handle the response
+			msg.ID = fmt.Sprintf("%d-%s", s.idx, msg.ID)
+
+			handler, ok := s.api.wsHandlers[msg.Type]
+			if ok {
+				// This message is answered by the client itself
+				go s.api.handleWSRequest(handler, msg)
+				continue
+			}
+
+			msgBytes, err = json.Marshal(msg)
+			if err != nil {
+				fmt.Println("error marshaling web socket message:", err)
+				continue
+			}
+
+			if !s.api.wsPending.track(msg.ID, msg.Type) {
+				fmt.Printf("WARN: ignoring websocket request %s of %s as a request with the same id is still waiting for a response\n", msg.ID, s.server.serverLocation)
+				continue
+			}
+			s.api.WSRequests.push(msgBytes)
+		}
+
+		s.lock.Lock()
+		s.conn = nil
+		s.lock.Unlock()
+		c.Close()
+
+		if s.isClosed() {
+			return
+		}
+	}
+}
+
+// ConnectToAllWebsockets connects to all the conenctions their websocket
+func (a *API) ConnectToAllWebsockets() {
+	if a.MockMode {
+		return
+	}
+
+	a.wsSessions = make([]*wsSession, len(a.connections))
+	for idx := range a.connections {
+		a.wsSessions[idx] = newWSSession(a, idx)
+	}
+	for _, session := range a.wsSessions {
+		go session.run()
+	}
+}
+
+// WebsocketStates returns the state of the websocket connection with every RT-CV server
+func (a *API) WebsocketStates() []WebsocketState {
+	states := []WebsocketState{}
+	for _, session := range a.wsSessions {
+		states = append(states, session.State())
+	}
+	return states
+}
+
+// CloseWebsockets closes the websocket of all connections
+func (a *API) CloseWebsockets() {
+	for _, session := range a.wsSessions {
+		session.close()
+	}
+}
+
+// FlushWebsockets waits until all buffered responses are written to the websockets
+// Returns false if there are still buffered responses left after the timeout
+func (a *API) FlushWebsockets(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		buffered := 0
+		for _, session := range a.wsSessions {
+			buffered += session.State().BufferedResponses
+		}
+		if buffered == 0 {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// SendWebsocketEvent sends a message that is not a response to a request of RT-CV to all connected RT-CV servers
+// Like responses the message is buffered while a websocket is disconnected
+func (a *API) SendWebsocketEvent(msgType string, data any) {
+	payload, err := json.Marshal(WSMsg[any]{Type: msgType, Data: data})
+	if err != nil {
+		fmt.Printf("WARN: unable to marshal websocket event %s, error: %s\n", msgType, err)
+		return
+	}
+
+	for _, session := range a.wsSessions {
+		if !session.isClosed() {
+			session.enqueue(msgType, payload)
+		}
+	}
+}
+
+// HandleWebsocketResponse handles a websocket response of the scraper
+// This decodes the payload and checks to which connected websocket it should be sent
+// Returns an error if the response is not for a pending request
+//
+// The response is buffered until it's written to the websocket, the returned channel receives nil once the response is written
+// or an error if the response was dropped
+func (a *API) HandleWebsocketResponse(payload []byte) (<-chan error, error) {
+	if a.MockMode {
+		written := make(chan error, 1)
+		written <- nil
+		return written, nil
+	}
+
+	data := WSMsg[json.RawMessage]{}
+	err := json.Unmarshal(payload, &data)
+	if err != nil {
+		return nil, fmt.Errorf("error un-marshaling websocket response, error: %s", err.Error())
+	}
+
+	err = a.wsPending.resolve(data.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.sendWebsocketResponse(data)
+}
+
+// sendWebsocketResponse adds a response to the outbound buffer of the connection the request came from
+func (a *API) sendWebsocketResponse(data WSMsg[json.RawMessage]) (<-chan error, error) {
+	idParts := strings.SplitN(data.ID, "-", 2)
+	if len(idParts) != 2 {
+		return nil, errors.New("error invalid id in websocket response, expected 2 parts but got 1")
+	}
+
+	idx, err := strconv.Atoi(idParts[0])
+	if err != nil {
+		return nil, fmt.Errorf("error invalid id connection index in websocket response, error: %s", err.Error())
+	}
+	if idx < 0 || idx >= len(a.wsSessions) {
+		return nil, fmt.Errorf("error invalid id in websocket response, there is no connection with index %d", idx)
+	}
+
+	data.ID = idParts[1]
+
+	// Re-encode data with the new ID
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling websocket response, error: %s", err.Error())
+	}
+
+	session := a.wsSessions[idx]
+	if session.isClosed() {
+		return nil, errors.New("the websocket connection is closed")
+	}
+	return session.enqueue(data.ID, payload), nil
+}
+
+// CancelPreviouseCommunication cancels the previous communication if it's still running
+func (a *API) CancelPreviouseCommunication() {
+	select {
+	case a.CancelPreviouseCommunicationChan <- struct{}{}:
+		// A previous communication was canceled
+	default:
+		// There are no more previous communications to cancel
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// fakeRTCVWebsocket is a stand-in for the websocket of a RT-CV server
+type fakeRTCVWebsocket struct {
+	server *httptest.Server
+	conns  chan *websocket.Conn
+	// reject makes the server refuse new connections
+	reject atomic.Bool
+}
+
+func newFakeRTCVWebsocket() *fakeRTCVWebsocket {
+	f := &fakeRTCVWebsocket{conns: make(chan *websocket.Conn, 10)}
+	upgrader := websocket.Upgrader{}
+	f.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/scraper/ws" || r.Header.Get("Authorization") == "" {
+			w.WriteHeader(404)
+			return
+		}
+		if f.reject.Load() {
+			w.WriteHeader(503)
+			return
+		}
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		f.conns <- conn
+	}))
+	return f
+}
+
+// accept waits for the scraper client to connect
+func (f *fakeRTCVWebsocket) accept(t *testing.T) *websocket.Conn {
+	select {
+	case conn := <-f.conns:
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("scraper client did not connect to", f.server.URL)
+		return nil
+	}
+}
+
+func (f *fakeRTCVWebsocket) close() {
+	f.server.CloseClientConnections()
+	f.server.Close()
+}
+
+func readWSMsg(t *testing.T, conn *websocket.Conn) WSMsg[json.RawMessage] {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg := WSMsg[json.RawMessage]{}
+	err := conn.ReadJSON(&msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func waitForWebsocketReq(t *testing.T, api *API) WSMsg[json.RawMessage] {
+	timeout := make(chan struct{})
+	timer := time.AfterFunc(5*time.Second, func() { close(timeout) })
+	defer timer.Stop()
+
+	req, ok := api.WSRequests.next(timeout)
+	if !ok {
+		t.Fatal("expected a websocket request")
+	}
+	msg := WSMsg[json.RawMessage]{}
+	checkErr(json.Unmarshal(req, &msg))
+	return msg
+}
+
+// respond sends a response of the scraper to RT-CV
+func respond(api *API, payload string) <-chan error {
+	written, err := api.HandleWebsocketResponse([]byte(payload))
+	checkErr(err)
+	return written
+}
+
+func sessionReconnects(s *wsSession) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.reconnects
+}
+
+func TestWebsocketSessionPerConnection(t *testing.T) {
+	primary := newFakeRTCVWebsocket()
+	defer primary.close()
+	alternative := newFakeRTCVWebsocket()
+	defer alternative.close()
+
+	api := newTestAPI(t)
+	checkErr(api.SetCredentials([]SetCredentialsArg{
+		{ServerLocation: primary.server.URL, APIKeyID: "a", APIKey: "b", Primary: true},
+		{ServerLocation: alternative.server.URL, APIKeyID: "a", APIKey: "b"},
+	}))
+	api.ConnectToAllWebsockets()
+	defer api.CloseWebsockets()
+
+	primaryConn := primary.accept(t)
+	alternativeConn := alternative.accept(t)
+
+	for _, test := range []struct {
+		conn       *websocket.Conn
+		expectedID string
+	}{
+		{alternativeConn, "1-abc"},
+		{primaryConn, "0-abc"},
+	} {
+		checkErr(test.conn.WriteJSON(WSMsg[string]{Type: "test", ID: "abc", Data: "request"}))
+		req := waitForWebsocketReq(t, api)
+		mustEq(test.expectedID, req.ID)
+
+		respond(api, `{"type":"test","id":"`+req.ID+`","data":"response"}`)
+		resp := readWSMsg(t, test.conn)
+		mustEq("abc", resp.ID)
+		mustEq(`"response"`, string(resp.Data))
+	}
+
+	_, err := api.HandleWebsocketResponse([]byte(`{"type":"test","id":"2-abc","data":null}`))
+	if err == nil {
+		t.Fatal("expected an error for a response to an unknown connection")
+	}
+}
+
+func TestWebsocketSessionReconnectsIndependently(t *testing.T) {
+	primary := newFakeRTCVWebsocket()
+	defer primary.close()
+	alternative := newFakeRTCVWebsocket()
+	defer alternative.close()
+
+	api := newTestAPI(t)
+	checkErr(api.SetCredentials([]SetCredentialsArg{
+		{ServerLocation: primary.server.URL, APIKeyID: "a", APIKey: "b", Primary: true},
+		{ServerLocation: alternative.server.URL, APIKeyID: "a", APIKey: "b"},
+	}))
+	api.ConnectToAllWebsockets()
+	defer api.CloseWebsockets()
+
+	primaryConn := primary.accept(t)
+	alternativeConn := alternative.accept(t)
+
+	// Dropping the alternative connection should only reconnect the alternative session
+	alternativeConn.Close()
+	alternativeConn = alternative.accept(t)
+
+	reconnects := sessionReconnects(api.wsSessions[1])
+	for i := 0; reconnects != 1 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		reconnects = sessionReconnects(api.wsSessions[1])
+	}
+	if reconnects != 1 {
+		t.Fatalf("expected the alternative session to reconnect once but got %d reconnects", reconnects)
+	}
+	if reconnects = sessionReconnects(api.wsSessions[0]); reconnects != 0 {
+		t.Fatalf("expected the primary session to not reconnect but got %d reconnects", reconnects)
+	}
+
+	checkErr(alternativeConn.WriteJSON(WSMsg[string]{Type: "test", ID: "def"}))
+	req := waitForWebsocketReq(t, api)
+	mustEq("1-def", req.ID)
+
+	respond(api, `{"type":"test","id":"1-def","data":true}`)
+	mustEq("def", readWSMsg(t, alternativeConn).ID)
+
+	checkErr(primaryConn.WriteJSON(WSMsg[string]{Type: "test", ID: "ghi"}))
+	mustEq("0-ghi", waitForWebsocketReq(t, api).ID)
+}
+
+// waitForDisconnect waits until the session noticed it's connection was lost
+func waitForDisconnect(t *testing.T, s *wsSession) {
+	for i := 0; i < 500; i++ {
+		s.lock.Lock()
+		disconnected := s.conn == nil
+		s.lock.Unlock()
+		if disconnected {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("expected the session to be disconnected")
+}
+
+func TestWebsocketResponseBufferedWhileDisconnected(t *testing.T) {
+	rtcv := newFakeRTCVWebsocket()
+	defer rtcv.close()
+
+	api := newTestAPI(t)
+	checkErr(api.SetCredentials([]SetCredentialsArg{
+		{ServerLocation: rtcv.server.URL, APIKeyID: "a", APIKey: "b"},
+	}))
+	api.ConnectToAllWebsockets()
+	defer api.CloseWebsockets()
+	rtcvConn := rtcv.accept(t)
+
+	checkErr(rtcvConn.WriteJSON(WSMsg[string]{Type: "test", ID: "a"}))
+	checkErr(rtcvConn.WriteJSON(WSMsg[string]{Type: "test", ID: "b"}))
+	mustEq("0-a", waitForWebsocketReq(t, api).ID)
+	mustEq("0-b", waitForWebsocketReq(t, api).ID)
+
+	rtcv.reject.Store(true)
+	rtcvConn.Close()
+	waitForDisconnect(t, api.wsSessions[0])
+
+	// The response is written once the connection is re-established
+	written := respond(api, `{"type":"test","id":"0-a","data":true}`)
+	select {
+	case err := <-written:
+		t.Fatalf("expected the response to not be written while disconnected, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	rtcv.reject.Store(false)
+	rtcvConn = rtcv.accept(t)
+	mustEq("a", readWSMsg(t, rtcvConn).ID)
+	checkErr(<-written)
+
+	// Responses older than the max age are dropped
+	rtcv.reject.Store(true)
+	rtcvConn.Close()
+	waitForDisconnect(t, api.wsSessions[0])
+	api.wsSessions[0].lock.Lock()
+	api.wsSessions[0].config.responseMaxAge = 10 * time.Millisecond
+	api.wsSessions[0].lock.Unlock()
+
+	written = respond(api, `{"type":"test","id":"0-b","data":true}`)
+	select {
+	case err := <-written:
+		if err == nil {
+			t.Fatal("expected the response to be dropped")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the response to be dropped")
+	}
+}
+
+func TestWebsocketReconnectsOnMissedPong(t *testing.T) {
+	rtcv := newFakeRTCVWebsocket()
+	defer rtcv.close()
+
+	api := newTestAPI(t)
+	checkErr(api.SetCredentials([]SetCredentialsArg{
+		{ServerLocation: rtcv.server.URL, APIKeyID: "a", APIKey: "b"},
+	}))
+	api.wsConfig = wsSessionConfig{pingInterval: 20 * time.Millisecond, pongWait: 100 * time.Millisecond}
+	api.ConnectToAllWebsockets()
+	defer api.CloseWebsockets()
+
+	// The fake server does not read from the connection so it never answers the pings like a half-open connection
+	rtcv.accept(t)
+	rtcv.accept(t)
+
+	state := api.WebsocketStates()[0]
+	for i := 0; state.Reconnects < 1 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+		state = api.WebsocketStates()[0]
+	}
+	if state.Reconnects < 1 {
+		t.Fatalf("expected at least one reconnect but got %d", state.Reconnects)
+	}
+	if !strings.Contains(state.LastError, "timeout") {
+		t.Fatalf("expected the last error to be a timeout but got %q", state.LastError)
+	}
+
+	// A connection that answers the pings stays connected
+	conn := rtcv.accept(t)
+	go func() {
+		for {
+			_, _, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+		}
+	}()
+	time.Sleep(300 * time.Millisecond)
+	mustEq(wsConnected, api.WebsocketStates()[0].State)
+	select {
+	case <-rtcv.conns:
+		t.Fatal("expected the connection that answers pings to stay connected")
+	default:
+	}
+}
+
+func TestWebsocketStuckWriteTimesOut(t *testing.T) {
+	rtcv := newFakeRTCVWebsocket()
+	defer rtcv.close()
+
+	api := newTestAPI(t)
+	checkErr(api.SetCredentials([]SetCredentialsArg{
+		{ServerLocation: rtcv.server.URL, APIKeyID: "a", APIKey: "b"},
+	}))
+	api.wsConfig = wsSessionConfig{writeWait: 300 * time.Millisecond}
+	api.ConnectToAllWebsockets()
+	defer api.CloseWebsockets()
+
+	// The fake server does not read from the connection so a large enough message can't be written, like a half-open connection
+	rtcv.accept(t)
+	api.SendWebsocketEvent("test", strings.Repeat("a", 64*1024*1024))
+	time.Sleep(100 * time.Millisecond)
+
+	// The state can still be read while the write is stuck
+	stateRead := make(chan WebsocketState, 1)
+	go func() {
+		stateRead <- api.WebsocketStates()[0]
+	}()
+	select {
+	case <-stateRead:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("expected the state to be readable while a write is stuck")
+	}
+
+	// Once the write deadline is reached the session reconnects and retries the message
+	rtcv.accept(t)
+}
+
+func TestWSReconnectBackoff(t *testing.T) {
+	for attempt := 1; attempt < 20; attempt++ {
+		backoff := wsReconnectBackoff(attempt)
+		if backoff > wsMaxReconnectBackoff {
+			t.Fatalf("attempt %d has a backoff of %s which is more than the max", attempt, backoff)
+		}
+		if attempt == 1 && backoff < time.Second/2 {
+			t.Fatalf("expected the first backoff to be at least half a second but got %s", backoff)
+		}
+		if attempt > 10 && backoff < wsMaxReconnectBackoff/2 {
+			t.Fatalf("attempt %d has a backoff of %s which is less than half the max", attempt, backoff)
+		}
+	}
+}
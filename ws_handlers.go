@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// version is the version of the scraper client, it's set at build time using:
+// go build -ldflags "-X main.version=v2.x.x"
+var version = "dev"
+
+// wsHandler answers a websocket request of RT-CV without involving the scraper
+// The returned value is sent as data of the response, if an error is returned it's sent as the error of the response
+type wsHandler func(a *API, data json.RawMessage) (any, error)
+
+// RegisterWSHandler makes the client answer websocket requests with the message type itself instead of forwarding them to the scraper
+// Should be called before connecting to the websockets
+func (a *API) RegisterWSHandler(msgType string, handler wsHandler) {
+	a.wsHandlers[msgType] = handler
+}
+
+// builtinWSHandlers returns the websocket handlers every client has
+func builtinWSHandlers() map[string]wsHandler {
+	return map[string]wsHandler{
+		"ping":            wsPing,
+		"client_status":   wsClientStatus,
+		"cache_lookup":    wsCacheLookup,
+		"pause_scraper":   wsPauseScraper,
+		"resume_scraper":  wsResumeScraper,
+		"stop_scraper":    wsStopScraper,
+		"restart_scraper": wsRestartScraper,
+	}
+}
+
+// handleWSRequest answers a websocket request using a handler
+// The id of msg is expected to contain the connection index, see wsSession.run
+func (a *API) handleWSRequest(handler wsHandler, msg WSMsg[json.RawMessage]) {
+	resp := WSMsg[json.RawMessage]{
+		Type: msg.Type,
+		ID:   msg.ID,
+	}
+
+	result, err := handler(a, msg.Data)
+	if err == nil {
+		resp.Data, err = json.Marshal(result)
+	}
+	if err != nil {
+		resp.Error = err.Error()
+	}
+
+	_, err = a.sendWebsocketResponse(resp)
+	if err != nil {
+		fmt.Printf("WARN: unable to answer websocket request %s of type %s, error: %s\n", msg.ID, msg.Type, err)
+	}
+}
+
+func wsPing(a *API, data json.RawMessage) (any, error) {
+	return "pong", nil
+}
+
+// ClientStatus is the response of the client_status websocket request
+type ClientStatus struct {
+	Version   string    `json:"version"`
+	StartedAt time.Time `json:"startedAt"`
+	// Uptime is the time since the client started in seconds
+	Uptime int64 `json:"uptime"`
+	// ScraperState is the state of the scraper if the client runs only one scraper
+	ScraperState string                `json:"scraperState,omitempty"`
+	Scrapers     []ScraperStatus       `json:"scrapers"`
+	Cache        map[string]CacheStats `json:"cache"`
+}
+
+func wsClientStatus(a *API, data json.RawMessage) (any, error) {
+	status := ClientStatus{
+		Version:   version,
+		StartedAt: a.startedAt,
+		Uptime:    int64(time.Since(a.startedAt).Seconds()),
+		Scrapers:  a.ScraperStatuses(),
+		Cache:     a.Cache.Stats(),
+	}
+	if len(a.Scrapers) == 0 {
+		status.ScraperState = scraperNotStarted
+	} else if scraper := a.onlyScraper(); scraper != nil {
+		status.ScraperState = scraper.Process.State()
+	}
+	return status, nil
+}
+
+// CacheLookupArg is the data of the cache_lookup websocket request
+type CacheLookupArg struct {
+	Namespace   string `json:"namespace"`
+	ReferenceNr string `json:"referenceNr"`
+}
+
+func wsCacheLookup(a *API, data json.RawMessage) (any, error) {
+	arg := CacheLookupArg{}
+	err := json.Unmarshal(data, &arg)
+	if err != nil {
+		return nil, fmt.Errorf("invalid data, error: %s", err.Error())
+	}
+	if arg.ReferenceNr == "" {
+		return nil, errors.New("referenceNr cannot be empty")
+	}
+	if arg.Namespace == "" {
+		arg.Namespace = defaultCacheNamespace
+	}
+
+	return map[string]bool{"exists": a.CacheEntryExists(arg.Namespace, arg.ReferenceNr)}, nil
+}
+
+// scraperStopTimeout is how long the stop_scraper and restart_scraper requests wait for the scraper to exit before responding
+const scraperStopTimeout = 10 * time.Second
+
+// ScraperControlArg is the optional data of the websocket requests that control the scrapers
+type ScraperControlArg struct {
+	// Scraper is the name of the scraper to control, if empty all scrapers are controlled
+	Scraper string `json:"scraper"`
+}
+
+// ScraperStateResp is the response of the websocket requests that control the scrapers
+type ScraperStateResp struct {
+	// State is set if a single scraper was controlled
+	State string `json:"state,omitempty"`
+	// Scrapers contains the state of every scraper by name if multiple scrapers were controlled
+	Scrapers map[string]string `json:"scrapers,omitempty"`
+	// Errors contains the error by name of the scrapers that could not be controlled if multiple scrapers were controlled
+	Errors map[string]string `json:"errors,omitempty"`
+}
+
+// controlScrapers applies control to the scrapers selected by the data of a websocket request
+// control returns the state of the scraper after it's applied
+// If multiple scrapers are controlled a failing scraper does not fail the request, its error is part of the response
+func (a *API) controlScrapers(data json.RawMessage, control func(s *Scraper) (string, error)) (any, error) {
+	arg := ScraperControlArg{}
+	if len(data) > 0 && string(data) != "null" {
+		err := json.Unmarshal(data, &arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid data, error: %s", err.Error())
+		}
+	}
+
+	scrapers := a.Scrapers
+	if arg.Scraper != "" {
+		scraper := a.findScraper(arg.Scraper)
+		if scraper == nil {
+			return nil, fmt.Errorf("unknown scraper %s", arg.Scraper)
+		}
+		scrapers = []*Scraper{scraper}
+	}
+	if len(scrapers) == 0 {
+		return nil, ErrScraperNotRunning
+	}
+
+	states := make([]string, len(scrapers))
+	errs := make([]error, len(scrapers))
+	var wg sync.WaitGroup
+	for idx, scraper := range scrapers {
+		wg.Add(1)
+		go func(idx int, scraper *Scraper) {
+			states[idx], errs[idx] = control(scraper)
+			wg.Done()
+		}(idx, scraper)
+	}
+	wg.Wait()
+
+	if len(scrapers) == 1 {
+		if errs[0] != nil {
+			return nil, errs[0]
+		}
+		return ScraperStateResp{State: states[0]}, nil
+	}
+
+	resp := ScraperStateResp{Scrapers: map[string]string{}}
+	for idx, scraper := range scrapers {
+		if errs[idx] != nil {
+			if resp.Errors == nil {
+				resp.Errors = map[string]string{}
+			}
+			resp.Errors[scraper.Name] = errs[idx].Error()
+			states[idx] = scraper.Process.State()
+		}
+		resp.Scrapers[scraper.Name] = states[idx]
+	}
+	return resp, nil
+}
+
+func wsPauseScraper(a *API, data json.RawMessage) (any, error) {
+	return a.controlScrapers(data, func(s *Scraper) (string, error) {
+		err := s.Process.Pause()
+		return s.Process.State(), err
+	})
+}
+
+func wsResumeScraper(a *API, data json.RawMessage) (any, error) {
+	return a.controlScrapers(data, func(s *Scraper) (string, error) {
+		err := s.Process.Resume()
+		return s.Process.State(), err
+	})
+}
+
+// wsStopScraper stops the scraper but keeps the client running so RT-CV can start it again using restart_scraper
+// A scraper that runs on a schedule only has its current run stopped
+func wsStopScraper(a *API, data json.RawMessage) (any, error) {
+	return a.controlScrapers(data, func(s *Scraper) (string, error) {
+		var err error
+		if s.Scheduler != nil {
+			err = s.Process.Stop()
+		} else {
+			err = s.Process.StopUntilRestart()
+		}
+		if err != nil {
+			return "", err
+		}
+		return s.Process.WaitForState(scraperStopTimeout, scraperStopped, scraperExited), nil
+	})
+}
+
+func wsRestartScraper(a *API, data json.RawMessage) (any, error) {
+	return a.controlScrapers(data, func(s *Scraper) (string, error) {
+		err := s.Process.Restart()
+		if err != nil {
+			return "", err
+		}
+		return s.Process.WaitForState(scraperStopTimeout, scraperRunning, scraperExited), nil
+	})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestBuiltinWSHandlers(t *testing.T) {
+	rtcv := newFakeRTCVWebsocket()
+	defer rtcv.close()
+
+	api := newTestAPI(t)
+	checkErr(api.SetCredentials([]SetCredentialsArg{
+		{ServerLocation: rtcv.server.URL, APIKeyID: "a", APIKey: "b"},
+	}))
+	api.RegisterWSHandler("custom", func(a *API, data json.RawMessage) (any, error) {
+		return string(data), nil
+	})
+	api.ConnectToAllWebsockets()
+	defer api.CloseWebsockets()
+	rtcvConn := rtcv.accept(t)
+
+	checkErr(rtcvConn.WriteJSON(WSMsg[any]{Type: "ping", ID: "1"}))
+	resp := readWSMsg(t, rtcvConn)
+	mustEq("1", resp.ID)
+	mustEq(`"pong"`, string(resp.Data))
+
+	api.SetCacheEntry("", "abc", time.Hour)
+	checkErr(rtcvConn.WriteJSON(WSMsg[CacheLookupArg]{Type: "cache_lookup", ID: "2", Data: CacheLookupArg{ReferenceNr: "abc"}}))
+	resp = readWSMsg(t, rtcvConn)
+	mustEq("2", resp.ID)
+	mustEq(`{"exists":true}`, string(resp.Data))
+
+	checkErr(rtcvConn.WriteJSON(WSMsg[any]{Type: "client_status", ID: "3"}))
+	status := ClientStatus{}
+	checkErr(json.Unmarshal(readWSMsg(t, rtcvConn).Data, &status))
+	mustEq(version, status.Version)
+	mustEq(scraperNotStarted, status.ScraperState)
+
+	checkErr(rtcvConn.WriteJSON(WSMsg[any]{Type: "pause_scraper", ID: "4"}))
+	resp = readWSMsg(t, rtcvConn)
+	mustEq(ErrScraperNotRunning.Error(), resp.Error)
+
+	checkErr(rtcvConn.WriteJSON(WSMsg[int]{Type: "custom", ID: "5", Data: 42}))
+	mustEq(`"42"`, string(readWSMsg(t, rtcvConn).Data))
+
+	// Message types without a handler are forwarded to the scraper
+	checkErr(rtcvConn.WriteJSON(WSMsg[any]{Type: "unknown", ID: "6"}))
+	mustEq("0-6", waitForWebsocketReq(t, api).ID)
+	if api.wsPending.Len() != 1 {
+		t.Fatalf("expected only the forwarded request to be pending but got %d pending requests", api.wsPending.Len())
+	}
+}
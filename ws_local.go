@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/valyala/fasthttp"
+)
+
+var localWSUpgrader = websocket.Upgrader{}
+
+// serveLocalWebsocket upgrades the request to a websocket over which the RT-CV requests are pushed to the scraper
+// The scraper can answer the requests over the same websocket
+func serveLocalWebsocket(ctx *fasthttp.RequestCtx, api *API, scraper *Scraper) {
+	// The websocket library only supports net/http so we convert the request and hijack the connection from fasthttp
+	req := &http.Request{
+		Method:     string(ctx.Method()),
+		Host:       string(ctx.Host()),
+		Header:     http.Header{},
+		RequestURI: string(ctx.RequestURI()),
+	}
+	ctx.Request.Header.VisitAll(func(key, value []byte) {
+		req.Header.Add(string(key), string(value))
+	})
+
+	if !websocket.IsWebSocketUpgrade(req) {
+		errorResp(ctx, 400, "expected a websocket upgrade request")
+		return
+	}
+
+	ctx.HijackSetNoResponse(true)
+	ctx.Hijack(func(c net.Conn) {
+		conn, err := localWSUpgrader.Upgrade(&hijackedResponseWriter{conn: c, header: http.Header{}}, req, nil)
+		if err != nil {
+			fmt.Println("WARN: unable to upgrade local websocket, error:", err)
+			return
+		}
+		newLocalWSConn(api, conn, scraper).serve()
+	})
+}
+
+// hijackedResponseWriter is a http.ResponseWriter and http.Hijacker on top of a connection hijacked from fasthttp
+type hijackedResponseWriter struct {
+	conn   net.Conn
+	header http.Header
+}
+
+func (w *hijackedResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *hijackedResponseWriter) Write(data []byte) (int, error) {
+	return w.conn.Write(data)
+}
+
+func (w *hijackedResponseWriter) WriteHeader(statusCode int) {
+	fmt.Fprintf(w.conn, "HTTP/1.1 %d %s\r\n", statusCode, http.StatusText(statusCode))
+	w.header.Write(w.conn)
+	w.conn.Write([]byte("\r\n"))
+}
+
+func (w *hijackedResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.conn, bufio.NewReadWriter(bufio.NewReader(w.conn), bufio.NewWriter(w.conn)), nil
+}
+
+// localWSConn is a websocket connection with the scraper
+type localWSConn struct {
+	api  *API
+	conn *websocket.Conn
+	// scraper is the scraper of the $SCRAPER_ADDRESS the connection was made to, nil if it's unknown
+	scraper *Scraper
+
+	writeLock sync.Mutex
+	closed    chan struct{}
+	pushDone  chan struct{}
+}
+
+func newLocalWSConn(api *API, conn *websocket.Conn, scraper *Scraper) *localWSConn {
+	return &localWSConn{
+		api:      api,
+		conn:     conn,
+		scraper:  scraper,
+		closed:   make(chan struct{}),
+		pushDone: make(chan struct{}),
+	}
+}
+
+func (c *localWSConn) write(data []byte) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
+	select {
+	case <-c.closed:
+		return websocket.ErrCloseSent
+	default:
+		return c.conn.WriteMessage(websocket.TextMessage, data)
+	}
+}
+
+// serve pushes the requests of RT-CV to the scraper and handles the responses until the connection is closed
+func (c *localWSConn) serve() {
+	go c.push()
+
+	for {
+		msgType, msgBytes, err := c.conn.ReadMessage()
+		if err != nil {
+			// The connection is owned by fasthttp and closed once we return so make sure we are no longer writing to it
+			c.conn.UnderlyingConn().SetWriteDeadline(time.Now())
+			c.writeLock.Lock()
+			close(c.closed)
+			c.writeLock.Unlock()
+			<-c.pushDone
+			return
+		}
+		// The websocket is a single long request so every message counts as activity for the watchdog
+		c.api.scraperActivity(c.scraper)
+		if msgType != websocket.TextMessage && msgType != websocket.BinaryMessage {
+			continue
+		}
+
+		msg := WSMsg[json.RawMessage]{}
+		json.Unmarshal(msgBytes, &msg)
+
+		written, err := c.api.HandleWebsocketResponse(msgBytes)
+		if err != nil {
+			c.writeResult(msg.ID, err)
+			continue
+		}
+		go func(id string) {
+			c.writeResult(id, <-written)
+		}(msg.ID)
+	}
+}
+
+// writeResult tells the scraper if a response was written to RT-CV or not
+// If err is nil an ack message is sent, otherwise an error message
+func (c *localWSConn) writeResult(id string, err error) {
+	result := WSMsg[json.RawMessage]{
+		Type: "ack",
+		ID:   id,
+	}
+	if err != nil {
+		result.Type = "error"
+		result.Error = err.Error()
+	}
+
+	resultBytes, _ := json.Marshal(result)
+	c.write(resultBytes)
+}
+
+// push writes the requests that were not yet delivered to a consumer to the scraper
+func (c *localWSConn) push() {
+	defer close(c.pushDone)
+
+	cursor := c.api.WSRequests.lastDelivered()
+	// Only client events that happen after connecting are sent
+	skipEventsUntil := c.api.WSRequests.lastEventID()
+	for {
+		events, added := c.api.WSRequests.after(cursor)
+		for _, event := range events {
+			if event.Event != "" && event.ID <= skipEventsUntil {
+				continue
+			}
+
+			data := event.Data
+			if event.Event != "" {
+				data, _ = json.Marshal(WSMsg[json.RawMessage]{Type: event.Event, Data: event.Data})
+			}
+
+			err := c.write(data)
+			if err != nil {
+				if !errors.Is(err, websocket.ErrCloseSent) {
+					fmt.Println("WARN: unable to write request to local websocket, error:", err)
+				}
+				return
+			}
+			cursor = event.ID
+			c.api.WSRequests.markDelivered(cursor)
+		}
+
+		select {
+		case <-added:
+		case <-c.closed:
+			return
+		}
+	}
+}
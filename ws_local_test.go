@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// readScraperMsg reads the next message send to the scraper ignoring connection state events
+func readScraperMsg(t *testing.T, conn *websocket.Conn) WSMsg[json.RawMessage] {
+	for {
+		msg := readWSMsg(t, conn)
+		if msg.Type != wsConnectionStateEvent {
+			return msg
+		}
+	}
+}
+
+func TestLocalWebsocket(t *testing.T) {
+	rtcv := newFakeRTCVWebsocket()
+	defer rtcv.close()
+
+	api := newTestAPI(t)
+	checkErr(api.SetCredentials([]SetCredentialsArg{
+		{ServerLocation: rtcv.server.URL, APIKeyID: "a", APIKey: "b"},
+	}))
+	api.wsPending.SetTimeouts(100*time.Millisecond, nil)
+	api.ConnectToAllWebsockets()
+	defer api.CloseWebsockets()
+	rtcvConn := rtcv.accept(t)
+
+	address, _ := startWebserver(Env{}, api, nil)
+	scraperConn, _, err := websocket.DefaultDialer.Dial(strings.Replace(address, "http://", "ws://", 1)+"/server_requests/ws", nil)
+	checkErr(err)
+	defer scraperConn.Close()
+
+	// A request answered over the local websocket is sent back to RT-CV
+	checkErr(rtcvConn.WriteJSON(WSMsg[string]{Type: "test", ID: "abc", Data: "request"}))
+	req := readScraperMsg(t, scraperConn)
+	mustEq("0-abc", req.ID)
+	mustEq(`"request"`, string(req.Data))
+
+	checkErr(scraperConn.WriteJSON(WSMsg[string]{Type: "test", ID: req.ID, Data: "response"}))
+	resp := readWSMsg(t, rtcvConn)
+	mustEq("abc", resp.ID)
+	mustEq(`"response"`, string(resp.Data))
+	ack := readScraperMsg(t, scraperConn)
+	mustEq("ack", ack.Type)
+	mustEq("0-abc", ack.ID)
+	if api.wsPending.Len() != 0 {
+		t.Fatal("expected the answered request to no longer be pending")
+	}
+
+	// A request that is not answered in time results in an error response to RT-CV
+	checkErr(rtcvConn.WriteJSON(WSMsg[string]{Type: "test", ID: "def", Data: "request"}))
+	mustEq("0-def", readScraperMsg(t, scraperConn).ID)
+	resp = readWSMsg(t, rtcvConn)
+	mustEq("def", resp.ID)
+	mustEq("test", resp.Type)
+	if resp.Error == "" {
+		t.Fatal("expected a timeout error")
+	}
+
+	// An invalid response is reported back to the scraper
+	checkErr(scraperConn.WriteJSON(WSMsg[json.RawMessage]{Type: "test", ID: "invalid"}))
+	errResp := readScraperMsg(t, scraperConn)
+	mustEq("error", errResp.Type)
+	mustEq("invalid", errResp.ID)
+}
+
+func TestLocalWebsocketWatchdogActivity(t *testing.T) {
+	api := newTestAPI(t)
+	api.SetMockMode()
+	process := NewScraperProcess("", []string{"true"}, nil)
+	scraper := &Scraper{
+		Process:  process,
+		Watchdog: NewWatchdog(process, WatchdogConfig{NoActivityTimeout: time.Minute}, nil),
+	}
+	api.Scrapers = []*Scraper{scraper}
+
+	address, _ := startWebserver(Env{}, api, nil)
+	scraperConn, _, err := websocket.DefaultDialer.Dial(strings.Replace(address, "http://", "ws://", 1)+"/server_requests/ws", nil)
+	checkErr(err)
+	defer scraperConn.Close()
+	connectedAt := *scraper.Watchdog.Status().LastActivity
+
+	// Every message over the websocket counts as activity, not only opening it
+	time.Sleep(10 * time.Millisecond)
+	checkErr(scraperConn.WriteJSON(WSMsg[json.RawMessage]{Type: "test", ID: "unknown"}))
+	mustEq("unknown", readScraperMsg(t, scraperConn).ID)
+	if !scraper.Watchdog.Status().LastActivity.After(connectedAt) {
+		t.Fatal("expected a message over the local websocket to count as activity")
+	}
+}
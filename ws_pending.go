@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// wsResponseTimeout is the default time the scraper has to answer a websocket request before an error is sent to RT-CV
+const wsResponseTimeout = time.Minute * 2
+
+// wsFinishedRetention is how long the ids of answered and timed out requests are remembered
+// This is used to give a clear error when the scraper answers a request twice or too late
+const wsFinishedRetention = time.Minute * 10
+
+// wsPendingRequests keeps track of the websocket requests that are waiting for a response of the scraper
+// If the scraper does not respond in time an error response is sent to RT-CV so it does not wait forever
+type wsPendingRequests struct {
+	api *API
+
+	lock     sync.Mutex
+	timeout  time.Duration
+	timeouts map[string]time.Duration
+	requests map[string]*wsPendingRequest
+	// finished contains the ids of requests that are no longer pending
+	finished  map[string]wsFinishedRequest
+	lastPrune time.Time
+}
+
+type wsPendingRequest struct {
+	msgType string
+	timer   *time.Timer
+}
+
+type wsFinishedRequest struct {
+	at       time.Time
+	timedOut bool
+}
+
+func newWSPendingRequests(api *API) *wsPendingRequests {
+	return &wsPendingRequests{
+		api:       api,
+		timeout:   wsResponseTimeout,
+		timeouts:  map[string]time.Duration{},
+		requests:  map[string]*wsPendingRequest{},
+		finished:  map[string]wsFinishedRequest{},
+		lastPrune: time.Now(),
+	}
+}
+
+// SetTimeouts sets the time the scraper has to answer a request
+// timeouts overwrites the default timeout for specific message types
+func (p *wsPendingRequests) SetTimeouts(timeout time.Duration, timeouts map[string]time.Duration) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if timeout > 0 {
+		p.timeout = timeout
+	}
+	p.timeouts = map[string]time.Duration{}
+	for msgType, msgTimeout := range timeouts {
+		p.timeouts[msgType] = msgTimeout
+	}
+}
+
+// timeoutFor returns the timeout of a message type
+// Expects the lock to be held
+func (p *wsPendingRequests) timeoutFor(msgType string) time.Duration {
+	timeout, ok := p.timeouts[msgType]
+	if ok && timeout > 0 {
+		return timeout
+	}
+	return p.timeout
+}
+
+// track starts tracking a request, the id is the id as the scraper sees it
+// Returns false if a request with the same id is already pending
+func (p *wsPendingRequests) track(id, msgType string) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.prune()
+
+	if _, ok := p.requests[id]; ok {
+		return false
+	}
+	delete(p.finished, id)
+
+	timeout := p.timeoutFor(msgType)
+	p.requests[id] = &wsPendingRequest{
+		msgType: msgType,
+		timer: time.AfterFunc(timeout, func() {
+			p.expire(id, timeout)
+		}),
+	}
+	return true
+}
+
+// resolve stops tracking a request
+// Returns an error if the request is unknown, was already answered or timed out
+func (p *wsPendingRequests) resolve(id string) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	request, ok := p.requests[id]
+	if ok {
+		request.timer.Stop()
+		delete(p.requests, id)
+		p.finished[id] = wsFinishedRequest{at: time.Now()}
+		return nil
+	}
+
+	finished, ok := p.finished[id]
+	if !ok {
+		return fmt.Errorf("unknown websocket request id %s", id)
+	}
+	if finished.timedOut {
+		return fmt.Errorf("websocket request %s timed out, an error response was already sent to RT-CV", id)
+	}
+	return fmt.Errorf("websocket request %s was already answered", id)
+}
+
+// expire sends an error response to RT-CV for a request the scraper did not answer in time
+func (p *wsPendingRequests) expire(id string, timeout time.Duration) {
+	p.lock.Lock()
+	request, ok := p.requests[id]
+	if ok {
+		delete(p.requests, id)
+		p.finished[id] = wsFinishedRequest{at: time.Now(), timedOut: true}
+	}
+	p.lock.Unlock()
+	if !ok {
+		return
+	}
+
+	errMsg := fmt.Sprintf("the scraper did not respond within %s", timeout)
+	fmt.Printf("WARN: websocket request %s of type %s timed out, %s\n", id, request.msgType, errMsg)
+
+	_, err := p.api.sendWebsocketResponse(WSMsg[json.RawMessage]{
+		Type:  request.msgType,
+		ID:    id,
+		Error: errMsg,
+	})
+	if err != nil {
+		fmt.Printf("WARN: unable to send timeout error for websocket request %s, error: %s\n", id, err)
+	}
+}
+
+// prune forgets the finished requests older than wsFinishedRetention
+// Expects the lock to be held
+func (p *wsPendingRequests) prune() {
+	now := time.Now()
+	if now.Sub(p.lastPrune) < time.Minute {
+		return
+	}
+	p.lastPrune = now
+
+	for id, finished := range p.finished {
+		if now.Sub(finished.at) > wsFinishedRetention {
+			delete(p.finished, id)
+		}
+	}
+}
+
+// Len returns the amount of requests waiting for a response
+func (p *wsPendingRequests) Len() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.requests)
+}
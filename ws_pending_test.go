@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWSPendingRequests(t *testing.T) {
+	rtcv := newFakeRTCVWebsocket()
+	defer rtcv.close()
+
+	api := newTestAPI(t)
+	checkErr(api.SetCredentials([]SetCredentialsArg{
+		{ServerLocation: rtcv.server.URL, APIKeyID: "a", APIKey: "b"},
+	}))
+	api.wsPending.SetTimeouts(time.Hour, map[string]time.Duration{"quick": 50 * time.Millisecond})
+	api.ConnectToAllWebsockets()
+	defer api.CloseWebsockets()
+	rtcvConn := rtcv.accept(t)
+
+	checkErr(rtcvConn.WriteJSON(WSMsg[string]{Type: "slow", ID: "a"}))
+	checkErr(rtcvConn.WriteJSON(WSMsg[string]{Type: "quick", ID: "b"}))
+	mustEq("0-a", waitForWebsocketReq(t, api).ID)
+	mustEq("0-b", waitForWebsocketReq(t, api).ID)
+
+	// Only the message type with the short timeout times out
+	resp := readWSMsg(t, rtcvConn)
+	mustEq("b", resp.ID)
+	mustEq("quick", resp.Type)
+	if !strings.Contains(resp.Error, "did not respond") {
+		t.Fatalf("expected a timeout error but got %q", resp.Error)
+	}
+	if api.wsPending.Len() != 1 {
+		t.Fatalf("expected 1 pending request but got %d", api.wsPending.Len())
+	}
+
+	_, err := api.HandleWebsocketResponse([]byte(`{"type":"quick","id":"0-b","data":null}`))
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected a timed out error but got %v", err)
+	}
+
+	respond(api, `{"type":"slow","id":"0-a","data":true}`)
+	mustEq("a", readWSMsg(t, rtcvConn).ID)
+
+	_, err = api.HandleWebsocketResponse([]byte(`{"type":"slow","id":"0-a","data":true}`))
+	if err == nil || !strings.Contains(err.Error(), "already answered") {
+		t.Fatalf("expected an already answered error but got %v", err)
+	}
+
+	_, err = api.HandleWebsocketResponse([]byte(`{"type":"slow","id":"0-unknown","data":true}`))
+	if err == nil || !strings.Contains(err.Error(), "unknown") {
+		t.Fatalf("expected an unknown id error but got %v", err)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// wsRequestQueue buffers the websocket requests of RT-CV until the scraper consumes them
+// Every request gets an incrementing event id so a consumer can resume where it left off
+//
+// Requests and client events share the ids but are limited separately, so a flapping connection can't push requests out of the buffer
+type wsRequestQueue struct {
+	maxRequests     int
+	maxClientEvents int
+
+	lock   sync.Mutex
+	events []wsRequestEvent
+	// requests and clientEvents are the amount of buffered events of each kind
+	requests     int
+	clientEvents int
+	lastID       uint64
+	// delivered is the id of the last event handed to a consumer
+	delivered uint64
+	// added is closed and replaced every time an event is pushed
+	added chan struct{}
+}
+
+type wsRequestEvent struct {
+	ID uint64
+	// Event is empty for requests of RT-CV and otherwise the name of a client event like wsConnectionStateEvent
+	Event string
+	Data  []byte
+}
+
+// wsConnectionStateEvent is the event name of a change in the websocket connection with a RT-CV server
+// The data of the event is a WebsocketState
+const wsConnectionStateEvent = "connection_state"
+
+// wsMaxClientEvents is the amount of client events kept for consumers that resume the stream
+const wsMaxClientEvents = 100
+
+func newWSRequestQueue(maxRequests int) *wsRequestQueue {
+	return &wsRequestQueue{
+		maxRequests:     maxRequests,
+		maxClientEvents: wsMaxClientEvents,
+		events:          []wsRequestEvent{},
+		added:           make(chan struct{}),
+	}
+}
+
+// push adds a request to the queue, if the queue holds the max amount of requests the oldest request is dropped
+func (q *wsRequestQueue) push(data []byte) uint64 {
+	return q.add("", data)
+}
+
+// pushEvent adds a client event to the queue, the value is encoded as json
+// Client events are only sent to consumers of the stream and the local websocket
+// If the queue holds the max amount of client events the oldest client event is dropped
+func (q *wsRequestQueue) pushEvent(event string, value any) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		fmt.Printf("WARN: unable to encode %s event, error: %s\n", event, err)
+		return
+	}
+	q.add(event, data)
+}
+
+func (q *wsRequestQueue) add(event string, data []byte) uint64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.lastID++
+	q.events = append(q.events, wsRequestEvent{ID: q.lastID, Event: event, Data: data})
+	if event == "" {
+		q.requests++
+		if q.requests > q.maxRequests {
+			dropped := q.dropOldest(false)
+			if dropped.ID > q.delivered {
+				fmt.Printf("WARN: dropping websocket request %d as no scraper consumed it and the buffer is full\n", dropped.ID)
+			}
+		}
+	} else {
+		q.clientEvents++
+		if q.clientEvents > q.maxClientEvents {
+			q.dropOldest(true)
+		}
+	}
+
+	close(q.added)
+	q.added = make(chan struct{})
+	return q.lastID
+}
+
+// dropOldest removes the oldest client event if clientEvent is true and otherwise the oldest request
+// Expects the lock to be held and at least one event of the kind to be buffered
+func (q *wsRequestQueue) dropOldest(clientEvent bool) wsRequestEvent {
+	for idx, event := range q.events {
+		if (event.Event != "") != clientEvent {
+			continue
+		}
+
+		q.events = append(q.events[:idx], q.events[idx+1:]...)
+		if clientEvent {
+			q.clientEvents--
+		} else {
+			q.requests--
+		}
+		return event
+	}
+	return wsRequestEvent{}
+}
+
+// after returns the buffered events with an id higher than id and a channel that is closed when a new event is pushed
+func (q *wsRequestQueue) after(id uint64) ([]wsRequestEvent, <-chan struct{}) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	events := []wsRequestEvent{}
+	for _, event := range q.events {
+		if event.ID > id {
+			events = append(events, event)
+		}
+	}
+	return events, q.added
+}
+
+// lastEventID returns the id of the last pushed event
+func (q *wsRequestQueue) lastEventID() uint64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.lastID
+}
+
+// lastDelivered returns the id of the last event handed to a consumer
+func (q *wsRequestQueue) lastDelivered() uint64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.delivered
+}
+
+// markDelivered marks all events up to and including id as delivered
+func (q *wsRequestQueue) markDelivered(id uint64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if id > q.delivered {
+		q.delivered = id
+	}
+}
+
+// next waits for the first request that was not yet delivered to a consumer and marks it as delivered
+// Returns false if cancel is closed or receives a value before a request is available
+func (q *wsRequestQueue) next(cancel <-chan struct{}) ([]byte, bool) {
+	for {
+		q.lock.Lock()
+		for _, event := range q.events {
+			if event.ID > q.delivered && event.Event == "" {
+				q.delivered = event.ID
+				q.lock.Unlock()
+				return event.Data, true
+			}
+		}
+		added := q.added
+		q.lock.Unlock()
+
+		select {
+		case <-added:
+		case <-cancel:
+			return nil, false
+		}
+	}
+}
+
+// stream writes the events as server-sent events to w until writing fails
+// If resume is false the stream starts at the first request that was not yet delivered to a consumer, otherwise after lastEventID
+func (q *wsRequestQueue) stream(w *bufio.Writer, lastEventID uint64, resume bool) {
+	// Comments are ignored by the client but let us detect a closed connection when there are no events
+	keepAliveTicker := time.NewTicker(time.Second * 15)
+	defer keepAliveTicker.Stop()
+
+	cursor := lastEventID
+	// Client events are only buffered for consumers that resume, a new consumer only receives the events that happen from now on
+	skipEventsUntil := uint64(0)
+	if !resume {
+		cursor = q.lastDelivered()
+		skipEventsUntil = q.lastEventID()
+	}
+
+	for {
+		events, added := q.after(cursor)
+		for _, event := range events {
+			if event.Event != "" && event.ID <= skipEventsUntil {
+				continue
+			}
+			if event.Event != "" {
+				fmt.Fprintf(w, "event: %s\n", event.Event)
+			}
+			fmt.Fprintf(w, "id: %d\ndata: %s\n\n", event.ID, event.Data)
+			cursor = event.ID
+		}
+
+		err := w.Flush()
+		if err != nil {
+			return
+		}
+		q.markDelivered(cursor)
+
+		select {
+		case <-added:
+		case <-keepAliveTicker.C:
+			w.WriteString(": keep-alive\n\n")
+		}
+	}
+}
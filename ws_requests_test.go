@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWSRequestQueueNext(t *testing.T) {
+	q := newWSRequestQueue(2)
+	q.push([]byte("a"))
+	q.push([]byte("b"))
+	q.push([]byte("c"))
+
+	cancel := make(chan struct{})
+	// Client events don't take up the space of requests
+	for i := 0; i < wsMaxClientEvents*2; i++ {
+		q.pushEvent(wsConnectionStateEvent, i)
+	}
+	events, _ := q.after(0)
+	if len(events) != 2+wsMaxClientEvents {
+		t.Fatalf("expected 2 requests and %d client events but got %d events", wsMaxClientEvents, len(events))
+	}
+
+	// "a" was dropped as the queue only holds 2 requests
+	for _, expected := range []string{"b", "c"} {
+		req, ok := q.next(cancel)
+		if !ok {
+			t.Fatal("expected a request")
+		}
+		mustEq(expected, string(req))
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		q.push([]byte("d"))
+	}()
+	req, ok := q.next(cancel)
+	if !ok {
+		t.Fatal("expected a request")
+	}
+	mustEq("d", string(req))
+
+	close(cancel)
+	_, ok = q.next(cancel)
+	if ok {
+		t.Fatal("expected next to be canceled")
+	}
+}
+
+// readSSEEvents reads n events from a server-sent events stream and returns their ids and data
+func readSSEEvents(t *testing.T, r *bufio.Reader, n int) [][2]string {
+	events := [][2]string{}
+	event := [2]string{}
+	for len(events) < n {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "id: "):
+			event[0] = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "data: "):
+			event[1] = strings.TrimPrefix(line, "data: ")
+		case line == "" && event[0] != "":
+			events = append(events, event)
+			event = [2]string{}
+		}
+	}
+	return events
+}
+
+func TestWSRequestQueueStream(t *testing.T) {
+	q := newWSRequestQueue(10)
+	q.push([]byte(`{"id":"0-a"}`))
+
+	// Messages are buffered until a consumer connects
+	r, w := io.Pipe()
+	go q.stream(bufio.NewWriter(w), 0, false)
+	br := bufio.NewReader(r)
+	events := readSSEEvents(t, br, 1)
+	mustEq("1", events[0][0])
+	mustEq(`{"id":"0-a"}`, events[0][1])
+
+	q.push([]byte(`{"id":"0-b"}`))
+	events = readSSEEvents(t, br, 1)
+	mustEq("2", events[0][0])
+	r.Close()
+	for i := 0; q.lastDelivered() != 2 && i < 100; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// A new consumer without a Last-Event-ID only receives undelivered messages
+	q.push([]byte(`{"id":"0-c"}`))
+	r, w = io.Pipe()
+	go q.stream(bufio.NewWriter(w), 0, false)
+	events = readSSEEvents(t, bufio.NewReader(r), 1)
+	mustEq("3", events[0][0])
+	r.Close()
+
+	// A consumer with a Last-Event-ID resumes after that event
+	r, w = io.Pipe()
+	go q.stream(bufio.NewWriter(w), 1, true)
+	events = readSSEEvents(t, bufio.NewReader(r), 2)
+	mustEq("2", events[0][0])
+	mustEq(`{"id":"0-b"}`, events[0][1])
+	mustEq("3", events[1][0])
+	r.Close()
+}